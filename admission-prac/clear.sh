@@ -1,2 +0,0 @@
-kubectl delete svc -n test test-mutate-webhook
-kubectl delete mutatingwebhookconfiguration test-admission-mutate
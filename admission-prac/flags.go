@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"practices/admission-prac/pkg/config"
+	"practices/admission-prac/pkg/render"
+)
+
+// commandOptions are flags of the commands themselves, they are not part of the config file
+type commandOptions struct {
+	configPath         string
+	dryRun             bool
+	renderFormat       string
+	renderOutput       string
+	image              string
+	serviceAccountName string
+}
+
+type stringSliceValue struct {
+	value *[]string
+}
+
+func (s *stringSliceValue) String() string {
+	if s.value == nil {
+		return ""
+	}
+	return strings.Join(*s.value, ",")
+}
+
+func (s *stringSliceValue) Set(value string) error {
+	// an empty value clears the list, like --interruptiontaints=
+	if value == "" {
+		*s.value = []string{}
+		return nil
+	}
+	*s.value = strings.Split(value, ",")
+	return nil
+}
+
+// bindFlags binds every flag to its field in cfg, the current value of the field is the default of the flag
+func bindFlags(fs *flag.FlagSet, cfg *config.WebhookConfig, options *commandOptions) {
+	fs.StringVar(&options.configPath, "config", "", "path of the config file, flags given as well override it")
+	fs.BoolVar(&options.dryRun, "dryrun", false, "with uninstall, only list what would be removed")
+	fs.StringVar(&options.renderFormat, "format", render.FormatYAML, "with render, output format, yaml or kustomize")
+	fs.StringVar(&options.renderOutput, "output", "-", "with render, file to write yaml to (- for stdout), or the directory for kustomize")
+	fs.StringVar(&options.image, "image", "ttl.sh/admission-prac", "with render, image of the webhook deployment")
+	fs.StringVar(&options.serviceAccountName, "serviceaccountname", "test-mutate-webhook", "with render, name of the serviceaccount and clusterrole")
+
+	fs.IntVar(&cfg.Server.LogLevel, "v", cfg.Server.LogLevel, "number for the log level verbosity")
+	fs.StringVar(&cfg.Server.Namespace, "namespace", cfg.Server.Namespace, "kubernetes namespace this program run in")
+	fs.StringVar(&cfg.Server.DeploymentName, "deploymentname", cfg.Server.DeploymentName, "name of the deployment this program run in, events are reported on it")
+	fs.StringVar(&cfg.Server.MutatePath, "mutatepath", cfg.Server.MutatePath, "mutate path")
+	fs.StringVar(&cfg.Server.ValidatePath, "validatepath", cfg.Server.ValidatePath, "validate path")
+	fs.StringVar(&cfg.Server.DevAddress, "devaddress", cfg.Server.DevAddress, "host:port the apiserver can reach this program on when it runs outside the cluster, "+
+		"the webhook is registered by url instead of a service and deregistered on exit")
+
+	fs.StringVar(&cfg.TLS.CertsDir, "certsdir", cfg.TLS.CertsDir, "directory the serving cert and key are read from or generated into")
+	fs.DurationVar(&cfg.TLS.CheckInterval.Duration, "certcheckinterval", cfg.TLS.CheckInterval.Duration, "interval of checking the serving cert and the installed caBundle")
+	fs.DurationVar(&cfg.TLS.WarningThreshold.Duration, "certwarningthreshold", cfg.TLS.WarningThreshold.Duration, "remaining validity of certs below which warnings are raised")
+	fs.DurationVar(&cfg.TLS.CriticalThreshold.Duration, "certcriticalthreshold", cfg.TLS.CriticalThreshold.Duration, "remaining validity of certs below which critical alerts are raised")
+
+	fs.BoolVar(&cfg.Registration.Disabled, "noselfregister", cfg.Registration.Disabled, "no selfregister")
+	fs.BoolVar(&cfg.Registration.DeregisterOnShutdown, "deregisteronshutdown", cfg.Registration.DeregisterOnShutdown, "delete the service and mutatingwebhookconfiguration when the server shuts down")
+	fs.StringVar(&cfg.Registration.ServiceName, "servicename", cfg.Registration.ServiceName, "name of service")
+	fs.IntVar(&cfg.Registration.ServicePort, "serviceport", cfg.Registration.ServicePort, "port of service")
+	fs.StringVar(&cfg.Registration.TargetPortName, "targetportname", cfg.Registration.TargetPortName, "name of targetport")
+	fs.StringVar(&cfg.Registration.ServiceSelectorKey, "serviceselectorkey", cfg.Registration.ServiceSelectorKey, "service selector key")
+	fs.StringVar(&cfg.Registration.ServiceSelectorValue, "serviceselectorvalue", cfg.Registration.ServiceSelectorValue, "service selector value")
+	fs.StringVar(&cfg.Registration.WebhookConfigName, "webhookconfigname", cfg.Registration.WebhookConfigName, "name of mutatewebhookconfiguration")
+	fs.StringVar(&cfg.Registration.WebhookName, "webhookname", cfg.Registration.WebhookName, "name of mutating admission webhook")
+	fs.StringVar(&cfg.Registration.ValidatingWebhookConfigName, "validatingwebhookconfigname", cfg.Registration.ValidatingWebhookConfigName, "name of validatingwebhookconfiguration")
+	fs.StringVar(&cfg.Registration.ValidatingWebhookName, "validatingwebhookname", cfg.Registration.ValidatingWebhookName, "name of validating admission webhook")
+	fs.StringVar(&cfg.Registration.NamespaceLabel, "namespacelabel", cfg.Registration.NamespaceLabel, "label of namespace to apply webhook")
+	fs.StringVar(&cfg.Registration.OptOutLabel, "optoutlabel", cfg.Registration.OptOutLabel, "pods with this label are not sent to the webhook, empty to send all pods")
+	fs.Var(&stringSliceValue{value: &cfg.Registration.Operations}, "operations", "comma separated operations on pods the webhook is called for")
+	fs.StringVar(&cfg.Registration.FailurePolicy, "failurepolicy", cfg.Registration.FailurePolicy, "failure policy, Fail or Ignore")
+	fs.IntVar(&cfg.Registration.TimeoutSeconds, "timeoutseconds", cfg.Registration.TimeoutSeconds, "seconds the apiserver waits for the webhook, between 1 and 30")
+	fs.StringVar(&cfg.Registration.ReinvocationPolicy, "reinvocationpolicy", cfg.Registration.ReinvocationPolicy, "reinvocation policy, Never or IfNeeded, IfNeeded calls the webhook again after other mutators changed the pod")
+	fs.StringVar(&cfg.Registration.MatchPolicy, "matchpolicy", cfg.Registration.MatchPolicy, "match policy, Exact or Equivalent")
+
+	fs.StringVar(&cfg.Placement.CapacityLabelKey, "capacitylabelkey", cfg.Placement.CapacityLabelKey, "node label telling the capacity type of a node")
+	fs.StringVar(&cfg.Placement.OnDemandValue, "ondemandvalue", cfg.Placement.OnDemandValue, "value of the capacity label on on-demand nodes")
+	fs.StringVar(&cfg.Placement.SpotValue, "spotvalue", cfg.Placement.SpotValue, "value of the capacity label on spot nodes")
+	fs.IntVar(&cfg.Placement.OnDemandReplicas, "ondemandreplicas", cfg.Placement.OnDemandReplicas, "pods of a replicaset sent to on-demand nodes, the rest go to spot")
+	fs.BoolVar(&cfg.Placement.StrictValidation, "strictvalidation", cfg.Placement.StrictValidation, "deny deployments the placement makes fragile instead of warning about them")
+	fs.BoolVar(&cfg.Rebalance.Enabled, "rebalance", cfg.Rebalance.Enabled, "evict a spot pod of replicasets left without a live on-demand pod, so its replacement goes to on-demand")
+	fs.DurationVar(&cfg.Rebalance.Interval.Duration, "rebalanceinterval", cfg.Rebalance.Interval.Duration, "interval of checking all replicasets for the rebalancer")
+	fs.DurationVar(&cfg.Rebalance.Cooldown.Duration, "rebalancecooldown", cfg.Rebalance.Cooldown.Duration, "time a replicaset is left alone after the rebalancer evicted one of its pods")
+	fs.IntVar(&cfg.Rebalance.EvictionsPerMinute, "rebalanceevictionsperminute", cfg.Rebalance.EvictionsPerMinute, "evictions of the rebalancer per minute over all replicasets")
+	fs.BoolVar(&cfg.Fallback.Enabled, "fallback", cfg.Fallback.Enabled, "send pods of a deployment to on-demand nodes while its spot pods are unschedulable, and back once spot capacity returns")
+	fs.DurationVar(&cfg.Fallback.Interval.Duration, "fallbackinterval", cfg.Fallback.Interval.Duration, "interval of checking all replicasets for the spot fallback")
+	fs.DurationVar(&cfg.Fallback.PendingTimeout.Duration, "fallbackpendingtimeout", cfg.Fallback.PendingTimeout.Duration, "time a spot pod may be unschedulable before its deployment falls back to on-demand")
+	fs.DurationVar(&cfg.Fallback.RetryAfter.Duration, "fallbackretryafter", cfg.Fallback.RetryAfter.Duration, "time a deployment stays on on-demand when no new spot node shows up")
+	fs.IntVar(&cfg.Fallback.EvictionsPerMinute, "fallbackevictionsperminute", cfg.Fallback.EvictionsPerMinute, "evictions of fallback pods per minute when going back to spot")
+	fs.Var(&stringSliceValue{value: &cfg.Interruption.Taints}, "interruptiontaints", "comma separated taint keys of nodes about to be reclaimed")
+	fs.Var(&stringSliceValue{value: &cfg.Interruption.Conditions}, "interruptionconditions", "comma separated node condition types that are true on nodes about to be reclaimed")
+	fs.Var(&stringSliceValue{value: &cfg.Interruption.NodePoolLabels}, "nodepoollabels", "comma separated labels naming the node pool of a node, for the interruption metrics")
+	fs.BoolVar(&cfg.Normalizer.Enabled, "normalizecapacitylabel", cfg.Normalizer.Enabled, "set the capacity label on nodes from provider labels or the normalizer rules of the config file")
+	fs.BoolVar(&cfg.Budget.Enabled, "ondemandbudget", cfg.Budget.Enabled, "cap the on-demand pods of the cluster, pods over the budget are sent to spot")
+	fs.Int64Var(&cfg.Budget.MaxPods, "ondemandbudgetpods", cfg.Budget.MaxPods, "most on-demand pods in the cluster, 0 for no cap")
+	fs.StringVar(&cfg.Budget.CPU, "ondemandbudgetcpu", cfg.Budget.CPU, "most cpu requested by on-demand pods in the cluster, empty for no cap")
+	fs.StringVar(&cfg.Budget.Memory, "ondemandbudgetmemory", cfg.Budget.Memory, "most memory requested by on-demand pods in the cluster, empty for no cap")
+	fs.BoolVar(&cfg.OnDemandPDB.Enabled, "ondemandpdb", cfg.OnDemandPDB.Enabled, "keep a poddisruptionbudget over the on-demand pods of each handled deployment")
+	fs.DurationVar(&cfg.OnDemandPDB.Interval.Duration, "ondemandpdbinterval", cfg.OnDemandPDB.Interval.Duration, "interval of checking all deployments for their on-demand poddisruptionbudget")
+	fs.BoolVar(&cfg.Priority.Enabled, "priorityclasses", cfg.Priority.Enabled, "set the priority class of pods by the tier they are sent to")
+	fs.BoolVar(&cfg.Priority.CreateClasses, "createpriorityclasses", cfg.Priority.CreateClasses, "create the priority classes that do not exist yet")
+	fs.BoolVar(&cfg.Placement.CapacityFallback, "capacityfallback", cfg.Placement.CapacityFallback, "send pods to the other capacity when the chosen one has no ready, schedulable node")
+	fs.BoolVar(&cfg.Placement.Audit, "audit", cfg.Placement.Audit, "do not patch pods, only record the decisions in the audit log and the metrics")
+}
+
+// loadConfig builds the effective config from the defaults, then the config file, then the flags in args.
+// It is called again on every change of the config file, so flags keep overriding the file
+func loadConfig(args []string) (*config.WebhookConfig, *commandOptions, error) {
+	// a first pass only finds the config file
+	options := &commandOptions{}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	bindFlags(fs, config.Default(), options)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := config.Default()
+	if options.configPath != "" {
+		if err := config.LoadFile(options.configPath, cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	options = &commandOptions{}
+	fs = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	bindFlags(fs, cfg, options)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, options, nil
+}
@@ -2,49 +2,63 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
+	"practices/admission-prac/pkg/certmonitor"
 	"practices/admission-prac/pkg/clientset"
 	"practices/admission-prac/pkg/config"
 	"practices/admission-prac/pkg/handler"
+	"practices/admission-prac/pkg/health"
+	"practices/admission-prac/pkg/metrics"
 	"practices/admission-prac/pkg/mutatingwebhookconfiguration"
+	"practices/admission-prac/pkg/normalizer"
+	"practices/admission-prac/pkg/priorityclass"
+	"practices/admission-prac/pkg/rbac"
+	"practices/admission-prac/pkg/recorder"
+	"practices/admission-prac/pkg/registration"
+	"practices/admission-prac/pkg/render"
 	"practices/admission-prac/pkg/service"
+	"practices/admission-prac/pkg/validatingwebhookconfiguration"
 
 	"github.com/sirupsen/logrus"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
 )
 
-var (
-	noSelfRegister        = flag.Bool("noselfregister", false, "no selfregister")
-	logLevel              = flag.Int("v", 4 /*Log Info*/, "number for the log level verbosity")
-	mutatePath            = flag.String("mutatepath", "/mutate", "mutate path")
-	failFailurePolicy     = "Fail"
-	failurePolicy         = flag.String("failurepolicy", failFailurePolicy, "failure policy")
-	defaultNamespaceLabel = "test-webhook"
-	namespaceLabel        = flag.String("namespacelabel", defaultNamespaceLabel, "label of namespace to apply webhook")
-	serviceSelectorKey    = flag.String("serviceselectorkey", "app", "service selector key")
-	serviceSelectorValue  = flag.String("serviceselectorvalue", "test-mutate-webhook", "service selector value")
-	servicePort           = flag.Int("serviceport", 443, "port of service")
-	targetPortName        = flag.String("targetportname", "admission-api", "name of targetport")
-	webhookConfigName     = flag.String("webhookconfigname", "test-admission-mutate", "name of mutatewebhookconfiguration")
-	webhookName           = flag.String("webhookname", "test-mutate-webhook.noorganization.io", "name of mutating admission webhook")
-	namespace             = flag.String("namespace", "test", "kubernetes namespace this program run in")
-	serviceName           = flag.String("servicename", "test-mutate-webhook", "name of service")
+const (
+	commandServe     = "serve"
+	commandUninstall = "uninstall"
+	commandRender    = "render"
+
+	listenPort = 18443
+	// renderConfigDir is where the rendered deployment mounts its config
+	renderConfigDir = "/etc/admission-prac"
 )
 
 var (
-	certsDir = "/etc/webhook/certs"
-	certKey  = "tls.key"
-	certFile = "tls.crt"
+	// webhookRules holds the webhook rule settings once they are validated
+	webhookRules mutatingwebhookconfiguration.MutatingWebhookConfigurationParameters
+	options      *commandOptions
+	// commandArgs are kept to apply the flags again over a reloaded config file
+	commandArgs []string
+	certKey     = "tls.key"
+	certFile    = "tls.crt"
 )
 
 type SelfRegisterParameters struct {
@@ -53,26 +67,143 @@ type SelfRegisterParameters struct {
 	CACert           bytes.Buffer
 }
 
+// usage: admission-prac [serve|uninstall|render] [flags], serve is the default
 func main() {
-	flag.Parse()
+	command := commandServe
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	commandArgs = args
+	cfg, loadedOptions, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("invalid config")
+		os.Exit(2)
+	}
+	options = loadedOptions
+	config.SetConfig(cfg)
 	setupLogging()
-	config.SetConfig(*namespace, *serviceName)
+	if err := validateWebhookRules(); err != nil {
+		logrus.WithError(err).Error("invalid config")
+		os.Exit(2)
+	}
+	handler.SetCertsDir(cfg.TLS.CertsDir)
+	if cfg.Server.DevAddress != "" {
+		host, _, err := net.SplitHostPort(cfg.Server.DevAddress)
+		if err != nil {
+			logrus.WithError(err).Error("invalid devaddress, must be host:port")
+			os.Exit(2)
+		}
+		handler.AddCertHost(host)
+	}
+
+	switch command {
+	case commandServe:
+		serve()
+	case commandUninstall:
+		uninstall()
+	case commandRender:
+		if err := renderManifests(); err != nil {
+			logrus.WithError(err).Error("render err")
+			os.Exit(1)
+		}
+	default:
+		logrus.Errorf("unknown command: %v", command)
+		os.Exit(2)
+	}
+}
+
+func serve() {
 	logrus.Println("starting")
+	cfg := config.GetConfig()
 	mux := http.NewServeMux()
-	mux.Handle(*mutatePath, handler.NewMutateHandler())
+	mux.Handle(cfg.Server.MutatePath, handler.NewMutateHandler())
+	mux.Handle(cfg.Server.ValidatePath, handler.NewValidateHandler())
+	mux.Handle("/readyz", health.NewReadyzHandler())
+	mux.Handle("/metrics", metrics.NewMetricsHandler())
 	server := http.Server{
 		Handler: mux,
-		Addr:    ":18443",
+		Addr:    fmt.Sprintf(":%d", listenPort),
+	}
+	if cfg.Server.DevAddress != "" {
+		// the port the apiserver calls is the one we listen on, there is no service in between
+		_, port, _ := net.SplitHostPort(cfg.Server.DevAddress)
+		server.Addr = ":" + port
+		logrus.WithField("devAddress", cfg.Server.DevAddress).Println("running in dev mode")
 	}
 
 	clientset.InitClientset()
+	checkPermissions()
+	recorder.InitRecorder()
+	if cfg.Priority.Enabled && cfg.Priority.CreateClasses {
+		for _, class := range cfg.Priority.Classes {
+			// a missing class only leaves the priority of the pods alone, the webhook still works
+			_ = priorityclass.CreatePriorityClass(priorityclass.PriorityClassParameters{
+				Name:        class.Name,
+				Value:       class.Value,
+				Description: fmt.Sprintf("priority of pods admission-prac sends to %s nodes", class.Tier),
+			})
+		}
+	}
 	stopCh := make(chan struct{})
-	defer close(stopCh)
-	go handler.StartInformer(stopCh)
+	informerFactory := handler.NewInformerFactory()
+	go handler.StartInformer(informerFactory, stopCh)
+	// replacing the on-demand pods of interrupted nodes is done by the rebalancer, it runs for them alone
+	// when periodic rebalancing is off
+	if cfg.Rebalance.Enabled || cfg.Interruption.Enabled() {
+		rebalancerParameters := handler.RebalancerParameters{
+			Interval:           cfg.Rebalance.Interval.Duration,
+			Cooldown:           cfg.Rebalance.Cooldown.Duration,
+			EvictionsPerMinute: cfg.Rebalance.EvictionsPerMinute,
+			InterruptionsOnly:  !cfg.Rebalance.Enabled,
+		}
+		go handler.StartRebalancer(rebalancerParameters, stopCh)
+	}
+	if cfg.Fallback.Enabled {
+		fallbackParameters := handler.FallbackParameters{
+			Interval:           cfg.Fallback.Interval.Duration,
+			PendingTimeout:     cfg.Fallback.PendingTimeout.Duration,
+			RetryAfter:         cfg.Fallback.RetryAfter.Duration,
+			EvictionsPerMinute: cfg.Fallback.EvictionsPerMinute,
+		}
+		go handler.StartFallback(fallbackParameters, stopCh)
+	}
+	if cfg.Budget.Enabled {
+		budgetStatusParameters := handler.BudgetStatusParameters{
+			Name:      cfg.Budget.StatusConfigMap,
+			Namespace: cfg.Server.Namespace,
+			Interval:  cfg.Budget.StatusInterval.Duration,
+		}
+		go handler.StartBudgetStatus(budgetStatusParameters, stopCh)
+	}
+	if cfg.OnDemandPDB.Enabled {
+		onDemandPDBParameters := handler.OnDemandPDBParameters{
+			Interval:   cfg.OnDemandPDB.Interval.Duration,
+			NameSuffix: cfg.OnDemandPDB.NameSuffix,
+		}
+		go handler.StartOnDemandPDB(onDemandPDBParameters, stopCh)
+	}
+	if cfg.Normalizer.Enabled {
+		go normalizer.Run(normalizer.NormalizerParameters{
+			Rules:        cfg.Normalizer.Rules,
+			NodeInformer: informerFactory.Core().V1().Nodes(),
+		}, stopCh)
+	}
+	if options.configPath != "" {
+		go config.Watch(options.configPath, reloadConfig, stopCh)
+	}
 
 	serverCertPEM, _, _ := handler.HandleCerts()
 
-	if !*noSelfRegister {
+	// the cert monitor waits for our caBundle, an old registration would look like a mismatch
+	registered := make(chan struct{})
+	if cfg.Registration.Disabled {
+		close(registered)
+	} else {
 		logrus.Println("to do self register")
 		selfRegisterParameters := SelfRegisterParameters{
 			// ServiceName:      "test-mutate-webhook",
@@ -81,69 +212,361 @@ func main() {
 			ServiceNamespace: config.GetNamespace(),
 			CACert:           *serverCertPEM,
 		}
-		go selfRegister(selfRegisterParameters)
+		go selfRegister(selfRegisterParameters, registered, stopCh)
 	}
 
-	certPath := filepath.Join(certsDir, certFile)
-	keyPath := filepath.Join(certsDir, certKey)
-	logrus.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+	certPath := filepath.Join(cfg.TLS.CertsDir, certFile)
+	keyPath := filepath.Join(cfg.TLS.CertsDir, certKey)
+	mutatingWebhookConfigName, _ := webhookConfigNames()
+	certMonitorParameters := certmonitor.CertMonitorParameters{
+		CertPath:                 certPath,
+		WebhookConfigurationName: mutatingWebhookConfigName,
+		WebhookName:              cfg.Registration.WebhookName,
+		DeploymentName:           cfg.Server.DeploymentName,
+		DeploymentNamespace:      config.GetNamespace(),
+		WarningThreshold:         cfg.TLS.WarningThreshold.Duration,
+		CriticalThreshold:        cfg.TLS.CriticalThreshold.Duration,
+		Interval:                 cfg.TLS.CheckInterval.Duration,
+	}
+	go func() {
+		select {
+		case <-registered:
+			certmonitor.Start(certMonitorParameters, stopCh)
+		case <-stopCh:
+		}
+	}()
+
+	go func() {
+		if err := server.ListenAndServeTLS(certPath, keyPath); err != nil && err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, os.Interrupt)
+	<-signalCh
+	logrus.Println("shutting down")
+	// stop the registration reconciler first, or it would put back what deregistering removes
+	close(stopCh)
+	// the dev mode registration is temporary, it must not keep calling a laptop that is gone
+	if (cfg.Registration.DeregisterOnShutdown || cfg.Server.DevAddress != "") && !cfg.Registration.Disabled {
+		deregister(false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("shutdown server err")
+	}
 	logrus.Println("exiting")
 }
 
-func selfRegister(parameters SelfRegisterParameters) {
-	logrus.Println("self registering")
-	// clientset.InitClientset()
+// reloadConfig applies placement changes of the config file live, the server keeps its connections.
+// Other sections are only read at startup
+func reloadConfig() {
+	cfg, _, err := loadConfig(commandArgs)
+	if err != nil {
+		logrus.WithError(err).Error("reload config err, keeping the current config")
+		return
+	}
+	current := config.GetConfig()
+	if !reflect.DeepEqual(current.Placement, cfg.Placement) {
+		config.SetPlacement(cfg.Placement)
+		logrus.WithField("placement", fmt.Sprintf("%+v", cfg.Placement)).Println("placement config reloaded")
+	}
+	if !reflect.DeepEqual(current.Server, cfg.Server) || !reflect.DeepEqual(current.TLS, cfg.TLS) || !reflect.DeepEqual(current.Registration, cfg.Registration) ||
+		!reflect.DeepEqual(current.Rebalance, cfg.Rebalance) || !reflect.DeepEqual(current.Fallback, cfg.Fallback) ||
+		!reflect.DeepEqual(current.Interruption, cfg.Interruption) || !reflect.DeepEqual(current.Normalizer, cfg.Normalizer) ||
+		!reflect.DeepEqual(current.Priority, cfg.Priority) || !reflect.DeepEqual(current.OnDemandPDB, cfg.OnDemandPDB) ||
+		!reflect.DeepEqual(current.Budget, cfg.Budget) {
+		logrus.Warn("only placement config is applied live, restart to apply the other changes")
+	}
+}
+
+// permissionParameters describes what the current config needs, and which objects it touches
+func permissionParameters() rbac.PermissionParameters {
+	cfg := config.GetConfig()
+	mutatingWebhookConfigName, validatingWebhookConfigName := webhookConfigNames()
+	return rbac.PermissionParameters{
+		SelfRegister:                       !cfg.Registration.Disabled,
+		ServiceName:                        config.GetServiceName(),
+		ServiceNamespace:                   config.GetNamespace(),
+		MutatingWebhookConfigurationName:   mutatingWebhookConfigName,
+		ValidatingWebhookConfigurationName: validatingWebhookConfigName,
+		Rebalance:                          cfg.Rebalance.Enabled,
+		Interruption:                       cfg.Interruption.Enabled(),
+		Fallback:                           cfg.Fallback.Enabled,
+		Normalizer:                         cfg.Normalizer.Enabled,
+		PriorityClasses:                    cfg.Priority.Enabled,
+		OnDemandPDB:                        cfg.OnDemandPDB.Enabled,
+		Budget:                             cfg.Budget.Enabled,
+		BudgetStatusConfigMap:              cfg.Budget.StatusConfigMap,
+		CreatePriorityClasses:              cfg.Priority.Enabled && cfg.Priority.CreateClasses,
+		DeploymentName:                     cfg.Server.DeploymentName,
+		DeploymentNamespace:                config.GetNamespace(),
+	}
+}
+
+// checkPermissions exits with every missing permission listed, instead of failing later in an informer or a create
+func checkPermissions() {
+	permissions := rbac.RequiredPermissions(permissionParameters())
+	missing, err := rbac.CheckPermissions(permissions)
+	if err != nil {
+		logrus.WithError(err).Warn("unable to check permissions, continuing")
+		return
+	}
+	if len(missing) > 0 {
+		for _, m := range missing {
+			logrus.Errorf("missing permission: %s", m)
+		}
+		logrus.Errorf("%d permissions missing, check the clusterrole and role bound to the serviceaccount", len(missing))
+		os.Exit(1)
+	}
+	logrus.Debug("all required permissions granted")
+}
+
+func uninstall() {
+	clientset.InitClientset()
+	removed := deregister(options.dryRun)
+	if options.dryRun {
+		fmt.Println("would remove:")
+	} else {
+		fmt.Println("removed:")
+	}
+	for _, item := range removed {
+		fmt.Printf("  %s\n", item)
+	}
+}
+
+// deregister removes what selfRegister and HandleCerts created and returns the removed items
+func deregister(dryRun bool) []string {
+	parameters := buildRegistrationParameters(SelfRegisterParameters{
+		ServiceName:      config.GetServiceName(),
+		ServiceNamespace: config.GetNamespace(),
+	})
+	removed, err := registration.Deregister(parameters, dryRun)
+	if err != nil {
+		logrus.WithError(err).Error("deregister err")
+	}
+	removedCerts, err := handler.RemoveCerts(dryRun)
+	if err != nil {
+		logrus.WithError(err).Error("remove certs err")
+	}
+	return append(removed, removedCerts...)
+}
+
+func renderManifests() error {
+	cfg := config.GetConfig()
+	serverCertPEM, serverPrivateKeyPEM, err := handler.GenerateCerts()
+	if err != nil {
+		return err
+	}
+	registrationParameters := buildRegistrationParameters(SelfRegisterParameters{
+		ServiceName:      config.GetServiceName(),
+		ServiceNamespace: config.GetNamespace(),
+		CACert:           *serverCertPEM,
+	})
+	// the deployment runs with the effective config of render, flags included, from a mounted configmap,
+	// so the placement can be changed by editing the configmap later
+	effective := *cfg
+	effective.Server.DevAddress = ""
+	configData, err := yaml.Marshal(effective)
+	if err != nil {
+		logrus.Errorf("yaml marshal config err: %v", err)
+		return err
+	}
+	renderParameters := render.RenderParameters{
+		Service:                        registrationParameters.Service,
+		MutatingWebhookConfiguration:   registrationParameters.MutatingWebhookConfiguration,
+		ValidatingWebhookConfiguration: registrationParameters.ValidatingWebhookConfiguration,
+		RBAC: rbac.RBACParameters{
+			ClusterRoleName:    options.serviceAccountName,
+			ServiceAccountName: options.serviceAccountName,
+			Namespace:          config.GetNamespace(),
+			Permissions:        permissionParameters(),
+		},
+		Deployment: render.DeploymentParameters{
+			Name:      cfg.Server.DeploymentName,
+			Namespace: config.GetNamespace(),
+			Labels: map[string]string{
+				cfg.Registration.ServiceSelectorKey: cfg.Registration.ServiceSelectorValue,
+			},
+			Image:         options.image,
+			Args:          []string{"--config=" + filepath.Join(renderConfigDir, render.ConfigFileName)},
+			ContainerPort: listenPort,
+			PortName:      cfg.Registration.TargetPortName,
+			CertsDir:      cfg.TLS.CertsDir,
+			SecretName:    config.GetServiceName() + "-certs",
+			ConfigMapName: config.GetServiceName() + "-config",
+			ConfigDir:     renderConfigDir,
+		},
+		TLSCert: serverCertPEM,
+		TLSKey:  serverPrivateKeyPEM,
+		Config:  configData,
+	}
+	objects := render.BuildObjects(renderParameters)
+
+	switch options.renderFormat {
+	case render.FormatKustomize:
+		return render.WriteKustomize(options.renderOutput, objects)
+	case render.FormatYAML:
+		if options.renderOutput == "-" {
+			return render.WriteYAML(os.Stdout, objects)
+		}
+		f, err := os.Create(options.renderOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return render.WriteYAML(f, objects)
+	}
+	return fmt.Errorf("unknown format: %v", options.renderFormat)
+}
+
+func selfRegister(parameters SelfRegisterParameters, registered chan struct{}, stopCh <-chan struct{}) {
+	registrationParameters := buildRegistrationParameters(parameters)
+	registrationParameters.Registered = registered
+	registration.Run(registrationParameters, stopCh)
+}
+
+func buildRegistrationParameters(parameters SelfRegisterParameters) registration.RegistrationParameters {
+	cfg := config.GetConfig()
 	serviceParameters := service.ServiceParameters{
 		Name:      parameters.ServiceName,
 		Namespace: parameters.ServiceNamespace,
 		Selector: map[string]string{
-			*serviceSelectorKey: *serviceSelectorValue,
+			cfg.Registration.ServiceSelectorKey: cfg.Registration.ServiceSelectorValue,
 		},
 		Ports: []corev1.ServicePort{
 			{
-				Port: int32(*servicePort),
+				Port: int32(cfg.Registration.ServicePort),
 				TargetPort: intstr.IntOrString{
 					Type:   intstr.String,
-					StrVal: *targetPortName,
+					StrVal: cfg.Registration.TargetPortName,
 				},
 			},
 		},
 	}
-	service.CreateService(serviceParameters)
 
+	mutatingWebhookConfigName, validatingWebhookConfigName := webhookConfigNames()
 	mutatingWebhookConfigurationParameters := mutatingwebhookconfiguration.MutatingWebhookConfigurationParameters{
-		ConfigurationName: *webhookConfigName,
-		WebhookName:       *webhookName,
+		ConfigurationName: mutatingWebhookConfigName,
+		WebhookName:       cfg.Registration.WebhookName,
 		ServiceReference: admissionregistrationv1.ServiceReference{
 			Name:      parameters.ServiceName,
 			Namespace: parameters.ServiceNamespace,
-			Path:      mutatePath,
+			Path:      &cfg.Server.MutatePath,
 		},
 		WebhookNamespaceSelector: metav1.LabelSelector{
 			MatchExpressions: []metav1.LabelSelectorRequirement{
 				{
-					Key:      *namespaceLabel,
+					Key:      cfg.Registration.NamespaceLabel,
 					Operator: metav1.LabelSelectorOpExists,
 				},
 			},
 		},
-		CACert: &parameters.CACert,
+		WebhookObjectSelector: webhookRules.WebhookObjectSelector,
+		FailurePolicy:         webhookRules.FailurePolicy,
+		Operations:            webhookRules.Operations,
+		TimeoutSeconds:        webhookRules.TimeoutSeconds,
+		ReinvocationPolicy:    webhookRules.ReinvocationPolicy,
+		MatchPolicy:           webhookRules.MatchPolicy,
+		CACert:                &parameters.CACert,
 	}
-	if *failurePolicy == failFailurePolicy {
-		mutatingWebhookConfigurationParameters.FailurePolicy = admissionregistrationv1.FailurePolicyType(admissionregistrationv1.Fail)
+	// deployments are only validated, never changed
+	validatingWebhookConfigurationParameters := validatingwebhookconfiguration.ValidatingWebhookConfigurationParameters{
+		ConfigurationName: validatingWebhookConfigName,
+		WebhookName:       cfg.Registration.ValidatingWebhookName,
+		ServiceReference: admissionregistrationv1.ServiceReference{
+			Name:      parameters.ServiceName,
+			Namespace: parameters.ServiceNamespace,
+			Path:      &cfg.Server.ValidatePath,
+		},
+		WebhookNamespaceSelector: mutatingWebhookConfigurationParameters.WebhookNamespaceSelector,
+		WebhookObjectSelector:    webhookRules.WebhookObjectSelector,
+		FailurePolicy:            webhookRules.FailurePolicy,
+		TimeoutSeconds:           webhookRules.TimeoutSeconds,
+		MatchPolicy:              webhookRules.MatchPolicy,
+		CACert:                   &parameters.CACert,
+	}
+	if cfg.Server.DevAddress != "" {
+		mutatingWebhookConfigurationParameters.URL = "https://" + cfg.Server.DevAddress + cfg.Server.MutatePath
+		validatingWebhookConfigurationParameters.URL = "https://" + cfg.Server.DevAddress + cfg.Server.ValidatePath
+	}
+	return registration.RegistrationParameters{
+		Service:                        serviceParameters,
+		MutatingWebhookConfiguration:   mutatingWebhookConfigurationParameters,
+		ValidatingWebhookConfiguration: validatingWebhookConfigurationParameters,
+		NoService:                      cfg.Server.DevAddress != "",
+	}
+}
+
+// webhookConfigNames are the names the webhook configurations are registered under. Dev mode registers
+// its own next to the deployed ones, so running and deregistering it leaves the deployed webhook alone
+func webhookConfigNames() (string, string) {
+	cfg := config.GetConfig()
+	if cfg.Server.DevAddress == "" {
+		return cfg.Registration.WebhookConfigName, cfg.Registration.ValidatingWebhookConfigName
+	}
+	suffix := "-dev-" + devHostName()
+	return cfg.Registration.WebhookConfigName + suffix, cfg.Registration.ValidatingWebhookConfigName + suffix
+}
+
+// devHostName is the hostname of this machine usable in an object name, the devaddress host without one
+func devHostName() string {
+	hostName, err := os.Hostname()
+	if err != nil || hostName == "" {
+		hostName, _, _ = net.SplitHostPort(config.GetConfig().Server.DevAddress)
+	}
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(hostName))
+	return strings.Trim(name, "-.")
+}
+
+func validateWebhookRules() error {
+	cfg := config.GetConfig()
+	var err error
+	if webhookRules.FailurePolicy, err = mutatingwebhookconfiguration.ParseFailurePolicy(cfg.Registration.FailurePolicy); err != nil {
+		return err
+	}
+	if webhookRules.ReinvocationPolicy, err = mutatingwebhookconfiguration.ParseReinvocationPolicy(cfg.Registration.ReinvocationPolicy); err != nil {
+		return err
+	}
+	if webhookRules.MatchPolicy, err = mutatingwebhookconfiguration.ParseMatchPolicy(cfg.Registration.MatchPolicy); err != nil {
+		return err
+	}
+	if webhookRules.Operations, err = mutatingwebhookconfiguration.ParseOperations(strings.Join(cfg.Registration.Operations, ",")); err != nil {
+		return err
+	}
+	webhookRules.TimeoutSeconds = int32(cfg.Registration.TimeoutSeconds)
+	if err = mutatingwebhookconfiguration.ValidateTimeoutSeconds(webhookRules.TimeoutSeconds); err != nil {
+		return err
+	}
+	webhookRules.WebhookObjectSelector = metav1.LabelSelector{}
+	if cfg.Registration.OptOutLabel != "" {
+		webhookRules.WebhookObjectSelector.MatchExpressions = []metav1.LabelSelectorRequirement{
+			{
+				Key:      cfg.Registration.OptOutLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			},
+		}
 	}
-	mutatingwebhookconfiguration.CreateMutateWebhookConfiguration(mutatingWebhookConfigurationParameters)
+	return nil
 }
 
 func setupLogging() {
 	// parse log level(default level: info)
+	logLevel := config.GetConfig().Server.LogLevel
 	var level logrus.Level
-	if *logLevel >= int(logrus.TraceLevel) {
+	if logLevel >= int(logrus.TraceLevel) {
 		level = logrus.TraceLevel
-	} else if *logLevel <= int(logrus.PanicLevel) {
+	} else if logLevel <= int(logrus.PanicLevel) {
 		level = logrus.PanicLevel
 	} else {
-		level = logrus.Level(*logLevel)
+		level = logrus.Level(logLevel)
 	}
 
 	logrus.SetLevel(level)
@@ -0,0 +1,218 @@
+package certmonitor
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/health"
+	"practices/admission-prac/pkg/recorder"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	healthCheckName = "certificates"
+
+	reasonCertificateMismatch = "CertificateMismatch"
+	reasonCertificateExpiring = "CertificateExpiring"
+	reasonCertificateExpired  = "CertificateExpired"
+)
+
+type CertMonitorParameters struct {
+	CertPath                 string
+	WebhookConfigurationName string
+	WebhookName              string
+	DeploymentName           string
+	DeploymentNamespace      string
+	// WarningThreshold and CriticalThreshold are the remaining validity below which alerts are raised
+	WarningThreshold  time.Duration
+	CriticalThreshold time.Duration
+	Interval          time.Duration
+}
+
+type certStatus struct {
+	servingNotAfter  time.Time
+	caBundleNotAfter time.Time
+	mismatch         bool
+	problems         []string
+}
+
+// Start checks the serving cert and the installed caBundle every interval until stopCh is closed
+func Start(parameters CertMonitorParameters, stopCh <-chan struct{}) {
+	logrus.Debug("starting cert monitor")
+	wait.Until(func() {
+		check(parameters)
+	}, parameters.Interval, stopCh)
+}
+
+func check(parameters CertMonitorParameters) {
+	details := map[string]string{}
+	servingCert, err := readServingCert(parameters.CertPath)
+	if err != nil {
+		logrus.WithField("certPath", parameters.CertPath).WithError(err).Error("read serving cert err")
+		details["servingCert"] = err.Error()
+		health.SetCheck(healthCheckName, false, details)
+		return
+	}
+	status := certStatus{
+		servingNotAfter: servingCert.NotAfter,
+	}
+	details["servingCertNotAfter"] = servingCert.NotAfter.Format(time.RFC3339)
+
+	caBundle, err := readCABundle(parameters.WebhookConfigurationName, parameters.WebhookName)
+	if apierrors.IsNotFound(err) {
+		// not registered (yet or any more), there is no caBundle to compare, the serving cert can still be checked
+		logrus.WithField("webhookConfigurationName", parameters.WebhookConfigurationName).Debug("webhook not registered, caBundle not checked")
+		details["caBundle"] = "not registered"
+	} else if err != nil {
+		logrus.WithField("webhookConfigurationName", parameters.WebhookConfigurationName).WithError(err).Warn("read caBundle err")
+		details["caBundle"] = err.Error()
+	} else {
+		status.caBundleNotAfter = earliestNotAfter(caBundle)
+		details["caBundleNotAfter"] = status.caBundleNotAfter.Format(time.RFC3339)
+		if !verifies(servingCert, caBundle) {
+			status.mismatch = true
+			status.problems = append(status.problems, "serving cert is not signed by the installed caBundle")
+		}
+	}
+
+	now := time.Now()
+	alert(parameters, &status, "serving cert", status.servingNotAfter, now)
+	if !status.caBundleNotAfter.IsZero() {
+		alert(parameters, &status, "caBundle", status.caBundleNotAfter, now)
+	}
+	if status.mismatch {
+		logrus.WithFields(logrus.Fields{
+			"alert":                    reasonCertificateMismatch,
+			"webhookConfigurationName": parameters.WebhookConfigurationName,
+			"webhookName":              parameters.WebhookName,
+		}).Error("serving cert does not match the installed caBundle")
+		emitWarning(parameters, reasonCertificateMismatch, fmt.Sprintf("serving cert is not signed by the caBundle of mutatingwebhookconfiguration %s", parameters.WebhookConfigurationName))
+	}
+
+	details["mismatch"] = fmt.Sprintf("%v", status.mismatch)
+	if len(status.problems) > 0 {
+		details["problems"] = fmt.Sprintf("%v", status.problems)
+	}
+	// an expired serving cert can not serve any request, everything else is reported but keeps the pod ready
+	health.SetCheck(healthCheckName, now.Before(status.servingNotAfter), details)
+}
+
+func alert(parameters CertMonitorParameters, status *certStatus, what string, notAfter time.Time, now time.Time) {
+	remaining := notAfter.Sub(now)
+	fields := logrus.Fields{
+		"cert":      what,
+		"notAfter":  notAfter.Format(time.RFC3339),
+		"remaining": remaining.String(),
+	}
+	switch {
+	case remaining <= 0:
+		fields["alert"] = reasonCertificateExpired
+		logrus.WithFields(fields).Error("certificate expired")
+		status.problems = append(status.problems, what+" expired")
+		emitWarning(parameters, reasonCertificateExpired, fmt.Sprintf("%s expired at %s", what, notAfter.Format(time.RFC3339)))
+	case remaining <= parameters.CriticalThreshold:
+		fields["alert"] = reasonCertificateExpiring
+		fields["threshold"] = parameters.CriticalThreshold.String()
+		logrus.WithFields(fields).Error("certificate is about to expire")
+		status.problems = append(status.problems, what+" is about to expire")
+		emitWarning(parameters, reasonCertificateExpiring, fmt.Sprintf("%s expires at %s", what, notAfter.Format(time.RFC3339)))
+	case remaining <= parameters.WarningThreshold:
+		fields["alert"] = reasonCertificateExpiring
+		fields["threshold"] = parameters.WarningThreshold.String()
+		logrus.WithFields(fields).Warn("certificate is close to expiry")
+		status.problems = append(status.problems, what+" is close to expiry")
+		emitWarning(parameters, reasonCertificateExpiring, fmt.Sprintf("%s expires at %s", what, notAfter.Format(time.RFC3339)))
+	}
+}
+
+func emitWarning(parameters CertMonitorParameters, reason, message string) {
+	deployment, err := clientset.GetClientset().AppsV1().Deployments(parameters.DeploymentNamespace).Get(context.TODO(), parameters.DeploymentName, v1.GetOptions{})
+	if err != nil {
+		logrus.WithField("deploymentName", parameters.DeploymentName).WithError(err).Warn("get webhook deployment for event err")
+		return
+	}
+	recorder.GetRecorder().Event(deployment, corev1.EventTypeWarning, reason, message)
+}
+
+func readServingCert(certPath string) (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCerts(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func readCABundle(configurationName, webhookName string) ([]*x509.Certificate, error) {
+	mutateAdmissionClient := clientset.GetClientset().AdmissionregistrationV1().MutatingWebhookConfigurations()
+	cfg, err := mutateAdmissionClient.Get(context.TODO(), configurationName, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range cfg.Webhooks {
+		if webhook.Name == webhookName {
+			return parseCerts(webhook.ClientConfig.CABundle)
+		}
+	}
+	return nil, fmt.Errorf("webhook %s not found in mutatingwebhookconfiguration %s", webhookName, configurationName)
+}
+
+func parseCerts(certsPEM []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, certsPEM = pem.Decode(certsPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
+
+func earliestNotAfter(certs []*x509.Certificate) time.Time {
+	notAfter := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return notAfter
+}
+
+func verifies(servingCert *x509.Certificate, caBundle []*x509.Certificate) bool {
+	roots := x509.NewCertPool()
+	for _, cert := range caBundle {
+		roots.AddCert(cert)
+	}
+	// expiry is reported on its own, only check the signature chain here
+	_, err := servingCert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: servingCert.NotBefore.Add(time.Second),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
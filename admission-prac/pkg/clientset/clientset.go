@@ -1,15 +1,21 @@
 package clientset
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 var (
 	clientset = &kubernetes.Clientset{}
+	// username is who the clientset acts as, only known with a serviceaccount token
+	username string
 )
 
 func InitClientset() {
@@ -26,8 +32,44 @@ func InitClientset() {
 		os.Exit(1)
 	}
 	clientset = cs
+	username = usernameOf(restConfig)
+	logrus.Debugf("acting as %q", username)
 }
 
 func GetClientset() *kubernetes.Clientset {
 	return clientset
 }
+
+// GetUsername is the user requests of the clientset come from, empty when unknown
+func GetUsername() string {
+	return username
+}
+
+// usernameOf reads the subject of a serviceaccount token, like system:serviceaccount:test:test-mutate-webhook.
+// The token is not verified, the apiserver does that, it only tells our own requests apart
+func usernameOf(restConfig *rest.Config) string {
+	token := restConfig.BearerToken
+	if token == "" && restConfig.BearerTokenFile != "" {
+		data, err := os.ReadFile(restConfig.BearerTokenFile)
+		if err != nil {
+			logrus.WithError(err).Debug("read token file err")
+			return ""
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Subject string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
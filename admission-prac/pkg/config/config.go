@@ -1,19 +1,586 @@
 package config
 
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "admission-prac/v1alpha1"
+	Kind       = "WebhookConfig"
+)
+
+// WebhookConfig is the versioned config file, every field can also be overridden by a flag
+type WebhookConfig struct {
+	APIVersion   string             `json:"apiVersion"`
+	Kind         string             `json:"kind"`
+	Server       ServerConfig       `json:"server"`
+	TLS          TLSConfig          `json:"tls"`
+	Registration RegistrationConfig `json:"registration"`
+	Placement    PlacementConfig    `json:"placement"`
+	Rebalance    RebalanceConfig    `json:"rebalance"`
+	Fallback     FallbackConfig     `json:"fallback"`
+	Interruption InterruptionConfig `json:"interruption"`
+	Normalizer   NormalizerConfig   `json:"normalizer"`
+	Priority     PriorityConfig     `json:"priority"`
+	OnDemandPDB  OnDemandPDBConfig  `json:"onDemandPDB"`
+	Budget       BudgetConfig       `json:"budget"`
+}
+
+type ServerConfig struct {
+	// Namespace is the namespace this program runs in
+	Namespace      string `json:"namespace"`
+	DeploymentName string `json:"deploymentName"`
+	MutatePath     string `json:"mutatePath"`
+	ValidatePath   string `json:"validatePath"`
+	LogLevel       int    `json:"logLevel"`
+	// DevAddress is the host:port the apiserver reaches this program on when it runs outside the cluster
+	DevAddress string `json:"devAddress,omitempty"`
+}
+
+type TLSConfig struct {
+	CertsDir          string      `json:"certsDir"`
+	CheckInterval     v1.Duration `json:"checkInterval"`
+	WarningThreshold  v1.Duration `json:"warningThreshold"`
+	CriticalThreshold v1.Duration `json:"criticalThreshold"`
+}
+
+type RegistrationConfig struct {
+	Disabled             bool   `json:"disabled"`
+	DeregisterOnShutdown bool   `json:"deregisterOnShutdown"`
+	ServiceName          string `json:"serviceName"`
+	ServicePort          int    `json:"servicePort"`
+	TargetPortName       string `json:"targetPortName"`
+	ServiceSelectorKey   string `json:"serviceSelectorKey"`
+	ServiceSelectorValue string `json:"serviceSelectorValue"`
+	WebhookConfigName    string `json:"webhookConfigName"`
+	WebhookName          string `json:"webhookName"`
+	// ValidatingWebhookConfigName and ValidatingWebhookName register the deployment validation
+	ValidatingWebhookConfigName string   `json:"validatingWebhookConfigName"`
+	ValidatingWebhookName       string   `json:"validatingWebhookName"`
+	NamespaceLabel              string   `json:"namespaceLabel"`
+	OptOutLabel                 string   `json:"optOutLabel"`
+	Operations                  []string `json:"operations"`
+	FailurePolicy               string   `json:"failurePolicy"`
+	TimeoutSeconds              int      `json:"timeoutSeconds"`
+	ReinvocationPolicy          string   `json:"reinvocationPolicy"`
+	MatchPolicy                 string   `json:"matchPolicy"`
+}
+
+// PlacementConfig is how pods are spread over on-demand and spot nodes, it is applied live when the file changes
+type PlacementConfig struct {
+	CapacityLabelKey string `json:"capacityLabelKey"`
+	OnDemandValue    string `json:"onDemandValue"`
+	SpotValue        string `json:"spotValue"`
+	// OnDemandReplicas is how many pods of a replicaset go to on-demand nodes, the rest go to spot
+	OnDemandReplicas int `json:"onDemandReplicas"`
+	// Audit only records the decisions in the audit log instead of patching pods
+	Audit bool `json:"audit"`
+	// StrictValidation denies deployments the placement makes fragile instead of warning about them
+	StrictValidation bool `json:"strictValidation"`
+	// CapacityFallback sends pods to the other capacity when the chosen one has no Ready, schedulable node,
+	// off by default as it moves pods to a capacity their owners did not ask for
+	CapacityFallback bool `json:"capacityFallback"`
+	// SpotSpread are the topology spread constraints added to spot pods, scoped to the spot pods of their replicaset,
+	// none by default
+	SpotSpread []SpreadConstraint `json:"spotSpread"`
+	// SpotInstanceTypeGroups are lists of instance types, the spot pods of a replicaset prefer them in turn
+	SpotInstanceTypeGroups [][]string `json:"spotInstanceTypeGroups"`
+	// SpotInstanceTypeWeight is the weight of the preferred node affinity term of the group, 1 to 100
+	SpotInstanceTypeWeight int32 `json:"spotInstanceTypeWeight"`
+	// Tiers are the node pools pods are sent to, filled in order. Empty means on-demand then spot by the capacity label
+	Tiers []TierConfig `json:"tiers"`
+}
+
+// TierConfig is a pool of nodes, like reserved instances, on-demand or spot
+type TierConfig struct {
+	Name         string            `json:"name"`
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// Quota is how many pods of a replicaset go to the tier, a count or a percentage of the replicas, empty for no limit.
+	// The on-demand tier takes onDemandReplicas and the on-demand annotations instead
+	Quota string `json:"quota,omitempty"`
+	// Fallback are the tiers tried in order when the tier has no available node
+	Fallback []string `json:"fallback,omitempty"`
+}
+
+// QuotaOf returns how many of the replicas go to the tier, false when the tier has no limit
+func (t TierConfig) QuotaOf(replicas int) (int, bool, error) {
+	if t.Quota == "" {
+		return 0, false, nil
+	}
+	if strings.HasSuffix(t.Quota, "%") {
+		value, err := strconv.Atoi(strings.TrimSuffix(t.Quota, "%"))
+		if err != nil || value < 0 || value > 100 {
+			return 0, false, fmt.Errorf("tier %s quota %q is not a percentage", t.Name, t.Quota)
+		}
+		// rounded up, so a small replicaset still gets a pod into the tier
+		return (replicas*value + 99) / 100, true, nil
+	}
+	value, err := strconv.Atoi(t.Quota)
+	if err != nil || value < 0 {
+		return 0, false, fmt.Errorf("tier %s quota %q is not a non-negative number or a percentage", t.Name, t.Quota)
+	}
+	return value, true, nil
+}
+
+// EffectiveTiers are the configured tiers, or on-demand then spot by the capacity label when none are
+func (p PlacementConfig) EffectiveTiers() []TierConfig {
+	if len(p.Tiers) > 0 {
+		return p.Tiers
+	}
+	return []TierConfig{
+		{
+			Name:         CapacityOnDemand,
+			NodeSelector: map[string]string{p.CapacityLabelKey: p.OnDemandValue},
+			Fallback:     []string{CapacitySpot},
+		},
+		{
+			Name:         CapacitySpot,
+			NodeSelector: map[string]string{p.CapacityLabelKey: p.SpotValue},
+			Fallback:     []string{CapacityOnDemand},
+		},
+	}
+}
+
+type SpreadConstraint struct {
+	MaxSkew           int32  `json:"maxSkew"`
+	TopologyKey       string `json:"topologyKey"`
+	WhenUnsatisfiable string `json:"whenUnsatisfiable"`
+}
+
+// RebalanceConfig is the controller restoring the on-demand pod of replicasets that lost it
+type RebalanceConfig struct {
+	Enabled bool `json:"enabled"`
+	// Interval is how often all replicasets are checked, pod changes trigger a check right away
+	Interval v1.Duration `json:"interval"`
+	// Cooldown is how long a replicaset is left alone after one of its pods was evicted
+	Cooldown           v1.Duration `json:"cooldown"`
+	EvictionsPerMinute int         `json:"evictionsPerMinute"`
+}
+
+// BudgetConfig caps the on-demand pods of the cluster, pods over it are sent to spot
+type BudgetConfig struct {
+	Enabled bool `json:"enabled"`
+	BudgetLimit
+	// Namespaces have their own caps within the cluster one, the unused cap of a namespace
+	// is held back from namespaces with a lower priority
+	Namespaces []NamespaceBudgetConfig `json:"namespaces"`
+	// StatusConfigMap in the webhook namespace gets the usage every StatusInterval
+	StatusConfigMap string      `json:"statusConfigMap"`
+	StatusInterval  v1.Duration `json:"statusInterval"`
+}
+
+// BudgetLimit caps on-demand pods by count and by their cpu and memory requests, zero or empty means no cap
+type BudgetLimit struct {
+	MaxPods int64  `json:"maxPods,omitempty"`
+	CPU     string `json:"cpu,omitempty"`
+	Memory  string `json:"memory,omitempty"`
+}
+
+func (l BudgetLimit) Validate() error {
+	if l.MaxPods < 0 {
+		return fmt.Errorf("budget maxPods must not be negative")
+	}
+	for _, value := range []string{l.CPU, l.Memory} {
+		if value == "" {
+			continue
+		}
+		if quantity, err := resource.ParseQuantity(value); err != nil || quantity.Sign() < 0 {
+			return fmt.Errorf("budget quantity %q is not a non-negative quantity", value)
+		}
+	}
+	return nil
+}
+
+type NamespaceBudgetConfig struct {
+	Namespace string `json:"namespace"`
+	BudgetLimit
+	Priority int `json:"priority,omitempty"`
+}
+
+// OnDemandPDBConfig is the controller keeping a poddisruptionbudget over the on-demand pods of each handled deployment
+type OnDemandPDBConfig struct {
+	Enabled  bool        `json:"enabled"`
+	Interval v1.Duration `json:"interval"`
+	// NameSuffix is appended to the deployment name to name its poddisruptionbudget
+	NameSuffix string `json:"nameSuffix"`
+}
+
+// FallbackConfig is the controller sending pods to on-demand while spot capacity is exhausted
+type FallbackConfig struct {
+	Enabled  bool        `json:"enabled"`
+	Interval v1.Duration `json:"interval"`
+	// PendingTimeout is how long a spot pod may be unschedulable before its deployment falls back to on-demand
+	PendingTimeout v1.Duration `json:"pendingTimeout"`
+	// RetryAfter is how long a deployment stays on on-demand when no new spot node shows up
+	RetryAfter         v1.Duration `json:"retryAfter"`
+	EvictionsPerMinute int         `json:"evictionsPerMinute"`
+}
+
+// InterruptionConfig tells how nodes about to be reclaimed are recognised
+type InterruptionConfig struct {
+	// Taints are taint keys set on nodes about to go, e.g. by the aws node termination handler or karpenter
+	Taints []string `json:"taints"`
+	// Conditions are node condition types that are true on nodes about to go
+	Conditions []string `json:"conditions"`
+	// NodePoolLabels are the labels naming the node pool of a node, the first one found is used in metrics
+	NodePoolLabels []string `json:"nodePoolLabels"`
+}
+
+// Enabled tells whether any interruption signal is watched for
+func (c InterruptionConfig) Enabled() bool {
+	return len(c.Taints) > 0 || len(c.Conditions) > 0
+}
+
+const (
+	CapacityOnDemand = "on-demand"
+	CapacitySpot     = "spot"
+)
+
+// PriorityConfig sets the priority class of pods by the tier they are sent to, so spot pods are preempted first
+type PriorityConfig struct {
+	Enabled bool `json:"enabled"`
+	// CreateClasses creates the classes that do not exist yet, existing classes are left as they are
+	CreateClasses bool                  `json:"createClasses"`
+	Classes       []PriorityClassConfig `json:"classes"`
+}
+
+type PriorityClassConfig struct {
+	Tier string `json:"tier"`
+	Name string `json:"name"`
+	// Value is only used when the class is created
+	Value int32 `json:"value"`
+}
+
+// NormalizerConfig is the controller setting the capacity label on nodes from provider labels or rules
+type NormalizerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Rules are tried in order, the first matching one gives the capacity of a node
+	Rules []CapacityRule `json:"rules"`
+}
+
+// CapacityRule matches a node by a label value or by its instance type
+type CapacityRule struct {
+	// Label and Regex match nodes whose Label value matches Regex
+	Label string `json:"label,omitempty"`
+	Regex string `json:"regex,omitempty"`
+	// InstanceTypes match nodes whose node.kubernetes.io/instance-type is listed
+	InstanceTypes []string `json:"instanceTypes,omitempty"`
+	// Capacity is on-demand or spot, the values of the capacity label come from the placement config
+	Capacity string `json:"capacity"`
+}
+
+func (r CapacityRule) Validate() error {
+	if r.Capacity != CapacityOnDemand && r.Capacity != CapacitySpot {
+		return fmt.Errorf("normalizer rule capacity %q must be %s or %s", r.Capacity, CapacityOnDemand, CapacitySpot)
+	}
+	if (r.Label == "") == (len(r.InstanceTypes) == 0) {
+		return fmt.Errorf("normalizer rule needs either label and regex or instanceTypes")
+	}
+	if r.Label != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil || r.Regex == "" {
+			return fmt.Errorf("normalizer rule for label %s needs a valid regex: %v", r.Label, err)
+		}
+	}
+	return nil
+}
+
 var (
-	namespace   = "test"
-	serviceName = "test-mutate-webhook"
+	lock    sync.RWMutex
+	current = Default()
 )
 
-func SetConfig(namespaceToSet, serviceNameToSet string) {
-	namespace = namespaceToSet
-	serviceName = serviceNameToSet
+func Default() *WebhookConfig {
+	return &WebhookConfig{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Server: ServerConfig{
+			Namespace:      "test",
+			DeploymentName: "test-mutate-webhook",
+			MutatePath:     "/mutate",
+			ValidatePath:   "/validate",
+			LogLevel:       4, /*Log Info*/
+		},
+		TLS: TLSConfig{
+			CertsDir:          "/etc/webhook/certs",
+			CheckInterval:     v1.Duration{Duration: time.Hour},
+			WarningThreshold:  v1.Duration{Duration: 30 * 24 * time.Hour},
+			CriticalThreshold: v1.Duration{Duration: 7 * 24 * time.Hour},
+		},
+		Registration: RegistrationConfig{
+			ServiceName:                 "test-mutate-webhook",
+			ServicePort:                 443,
+			TargetPortName:              "admission-api",
+			ServiceSelectorKey:          "app",
+			ServiceSelectorValue:        "test-mutate-webhook",
+			WebhookConfigName:           "test-admission-mutate",
+			WebhookName:                 "test-mutate-webhook.noorganization.io",
+			ValidatingWebhookConfigName: "test-admission-validate",
+			ValidatingWebhookName:       "test-validate-webhook.noorganization.io",
+			NamespaceLabel:              "test-webhook",
+			OptOutLabel:                 "placement-opt-out",
+			Operations:                  []string{"CREATE"},
+			FailurePolicy:               "Fail",
+			TimeoutSeconds:              10,
+			ReinvocationPolicy:          "IfNeeded",
+			MatchPolicy:                 "Equivalent",
+		},
+		Placement: PlacementConfig{
+			CapacityLabelKey:       "node.kubernetes.io/capacity",
+			OnDemandValue:          "on-demand",
+			SpotValue:              "spot",
+			OnDemandReplicas:       1,
+			SpotInstanceTypeWeight: 50,
+			SpotSpread:             []SpreadConstraint{},
+		},
+		Rebalance: RebalanceConfig{
+			Interval:           v1.Duration{Duration: time.Minute},
+			Cooldown:           v1.Duration{Duration: 5 * time.Minute},
+			EvictionsPerMinute: 1,
+		},
+		Interruption: InterruptionConfig{
+			Taints: []string{
+				"aws-node-termination-handler/spot-itn",
+				"aws-node-termination-handler/rebalance-recommendation",
+				"karpenter.sh/disruption",
+				"karpenter.sh/disrupted",
+				"cloud.google.com/impending-node-termination",
+				"DeletionCandidateOfClusterAutoscaler",
+				"ToBeDeletedByClusterAutoscaler",
+			},
+			Conditions: []string{},
+			NodePoolLabels: []string{
+				"karpenter.sh/nodepool",
+				"eks.amazonaws.com/nodegroup",
+				"cloud.google.com/gke-nodepool",
+				"kubernetes.azure.com/agentpool",
+			},
+		},
+		Budget: BudgetConfig{
+			StatusConfigMap: "admission-prac-budget",
+			StatusInterval:  v1.Duration{Duration: 30 * time.Second},
+		},
+		OnDemandPDB: OnDemandPDBConfig{
+			Interval:   v1.Duration{Duration: time.Minute},
+			NameSuffix: "-on-demand",
+		},
+		Priority: PriorityConfig{
+			CreateClasses: true,
+			Classes: []PriorityClassConfig{
+				{Tier: CapacityOnDemand, Name: "admission-prac-on-demand", Value: 1000},
+				{Tier: CapacitySpot, Name: "admission-prac-spot", Value: 100},
+			},
+		},
+		Normalizer: NormalizerConfig{
+			Rules: []CapacityRule{
+				{Label: "eks.amazonaws.com/capacityType", Regex: "^ON_DEMAND$", Capacity: CapacityOnDemand},
+				{Label: "eks.amazonaws.com/capacityType", Regex: "^SPOT$", Capacity: CapacitySpot},
+				{Label: "karpenter.sh/capacity-type", Regex: "^on-demand$", Capacity: CapacityOnDemand},
+				{Label: "karpenter.sh/capacity-type", Regex: "^spot$", Capacity: CapacitySpot},
+				{Label: "cloud.google.com/gke-spot", Regex: "^true$", Capacity: CapacitySpot},
+				{Label: "cloud.google.com/gke-preemptible", Regex: "^true$", Capacity: CapacitySpot},
+				{Label: "kubernetes.azure.com/scalesetpriority", Regex: "^spot$", Capacity: CapacitySpot},
+			},
+		},
+		Fallback: FallbackConfig{
+			Interval:           v1.Duration{Duration: time.Minute},
+			PendingTimeout:     v1.Duration{Duration: 5 * time.Minute},
+			RetryAfter:         v1.Duration{Duration: 30 * time.Minute},
+			EvictionsPerMinute: 1,
+		},
+	}
+}
+
+// LoadFile reads the config file over cfg, fields missing in the file keep their value in cfg
+func LoadFile(path string, cfg *WebhookConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg *WebhookConfig) Validate() error {
+	if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+		return fmt.Errorf("unsupported config %s/%s, want apiVersion %s and kind %s", cfg.APIVersion, cfg.Kind, APIVersion, Kind)
+	}
+	if cfg.Server.Namespace == "" {
+		return fmt.Errorf("server.namespace must be set")
+	}
+	if cfg.TLS.CertsDir == "" {
+		return fmt.Errorf("tls.certsDir must be set")
+	}
+	if cfg.TLS.CheckInterval.Duration <= 0 {
+		return fmt.Errorf("tls.checkInterval must be positive")
+	}
+	if cfg.TLS.CriticalThreshold.Duration > cfg.TLS.WarningThreshold.Duration {
+		return fmt.Errorf("tls.criticalThreshold must not be longer than tls.warningThreshold")
+	}
+	if cfg.Registration.ServiceName == "" || cfg.Registration.WebhookConfigName == "" || cfg.Registration.WebhookName == "" {
+		return fmt.Errorf("registration.serviceName, registration.webhookConfigName and registration.webhookName must be set")
+	}
+	if cfg.Registration.ValidatingWebhookConfigName == "" || cfg.Registration.ValidatingWebhookName == "" {
+		return fmt.Errorf("registration.validatingWebhookConfigName and registration.validatingWebhookName must be set")
+	}
+	if cfg.Registration.ServicePort < 1 || cfg.Registration.ServicePort > 65535 {
+		return fmt.Errorf("invalid registration.servicePort %d", cfg.Registration.ServicePort)
+	}
+	if cfg.Rebalance.Interval.Duration <= 0 || cfg.Rebalance.Cooldown.Duration < 0 {
+		return fmt.Errorf("rebalance.interval must be positive and rebalance.cooldown not negative")
+	}
+	if cfg.Rebalance.EvictionsPerMinute < 1 {
+		return fmt.Errorf("rebalance.evictionsPerMinute must be at least 1")
+	}
+	if cfg.Fallback.Interval.Duration <= 0 || cfg.Fallback.PendingTimeout.Duration <= 0 || cfg.Fallback.RetryAfter.Duration <= 0 {
+		return fmt.Errorf("fallback.interval, fallback.pendingTimeout and fallback.retryAfter must be positive")
+	}
+	if cfg.Fallback.EvictionsPerMinute < 1 {
+		return fmt.Errorf("fallback.evictionsPerMinute must be at least 1")
+	}
+	if cfg.OnDemandPDB.Interval.Duration <= 0 || cfg.OnDemandPDB.NameSuffix == "" {
+		return fmt.Errorf("onDemandPDB.interval must be positive and onDemandPDB.nameSuffix set")
+	}
+	if err := cfg.Budget.Validate(); err != nil {
+		return err
+	}
+	if cfg.Budget.StatusConfigMap == "" || cfg.Budget.StatusInterval.Duration <= 0 {
+		return fmt.Errorf("budget.statusConfigMap must be set and budget.statusInterval positive")
+	}
+	budgetNamespaces := make(map[string]bool)
+	for _, namespaceBudget := range cfg.Budget.Namespaces {
+		if namespaceBudget.Namespace == "" || budgetNamespaces[namespaceBudget.Namespace] {
+			return fmt.Errorf("budget.namespaces must be set and unique, %q is not", namespaceBudget.Namespace)
+		}
+		budgetNamespaces[namespaceBudget.Namespace] = true
+		if err := namespaceBudget.Validate(); err != nil {
+			return fmt.Errorf("namespace %s: %v", namespaceBudget.Namespace, err)
+		}
+	}
+	tiers := make(map[string]bool)
+	for _, tier := range cfg.Placement.EffectiveTiers() {
+		tiers[tier.Name] = true
+	}
+	classTiers := make(map[string]bool)
+	for _, class := range cfg.Priority.Classes {
+		if class.Name == "" || !tiers[class.Tier] || classTiers[class.Tier] {
+			return fmt.Errorf("priority.classes need a name and a tier of the placement, once per tier, %q is not", class.Tier)
+		}
+		classTiers[class.Tier] = true
+	}
+	for _, rule := range cfg.Normalizer.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return cfg.Placement.Validate()
+}
+
+func (p PlacementConfig) Validate() error {
+	if p.CapacityLabelKey == "" || p.OnDemandValue == "" || p.SpotValue == "" {
+		return fmt.Errorf("placement.capacityLabelKey, placement.onDemandValue and placement.spotValue must be set")
+	}
+	if p.OnDemandValue == p.SpotValue {
+		return fmt.Errorf("placement.onDemandValue and placement.spotValue must differ")
+	}
+	if p.OnDemandReplicas < 0 {
+		return fmt.Errorf("placement.onDemandReplicas must not be negative")
+	}
+	if p.SpotInstanceTypeWeight < 1 || p.SpotInstanceTypeWeight > 100 {
+		return fmt.Errorf("placement.spotInstanceTypeWeight must be between 1 and 100")
+	}
+	for _, group := range p.SpotInstanceTypeGroups {
+		if len(group) == 0 {
+			return fmt.Errorf("placement.spotInstanceTypeGroups must not have empty groups")
+		}
+	}
+	if err := validateTiers(p.Tiers); err != nil {
+		return err
+	}
+	for _, spread := range p.SpotSpread {
+		if spread.TopologyKey == "" || spread.MaxSkew < 1 {
+			return fmt.Errorf("placement.spotSpread needs a topologyKey and a maxSkew of at least 1")
+		}
+		if spread.WhenUnsatisfiable != "DoNotSchedule" && spread.WhenUnsatisfiable != "ScheduleAnyway" {
+			return fmt.Errorf("placement.spotSpread whenUnsatisfiable %q must be DoNotSchedule or ScheduleAnyway", spread.WhenUnsatisfiable)
+		}
+	}
+	return nil
+}
+
+func validateTiers(tiers []TierConfig) error {
+	if len(tiers) == 0 {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, tier := range tiers {
+		if tier.Name == "" || names[tier.Name] {
+			return fmt.Errorf("placement.tiers names must be set and unique, %q is not", tier.Name)
+		}
+		names[tier.Name] = true
+		if len(tier.NodeSelector) == 0 {
+			return fmt.Errorf("placement.tiers %s needs a nodeSelector", tier.Name)
+		}
+		if tier.Name == CapacityOnDemand && tier.Quota != "" {
+			return fmt.Errorf("placement.tiers %s takes its quota from onDemandReplicas, quota must not be set", tier.Name)
+		}
+		if _, _, err := tier.QuotaOf(0); err != nil {
+			return err
+		}
+	}
+	if !names[CapacityOnDemand] || !names[CapacitySpot] {
+		return fmt.Errorf("placement.tiers must have the %s and %s tiers", CapacityOnDemand, CapacitySpot)
+	}
+	for _, tier := range tiers {
+		for _, fallback := range tier.Fallback {
+			if !names[fallback] || fallback == tier.Name {
+				return fmt.Errorf("placement.tiers %s falls back to unknown tier %q", tier.Name, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+func SetConfig(cfg *WebhookConfig) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = cfg
+}
+
+// SetPlacement swaps the placement settings only, the rest of the config needs a restart to change
+func SetPlacement(placement PlacementConfig) {
+	lock.Lock()
+	defer lock.Unlock()
+	updated := *current
+	updated.Placement = placement
+	current = &updated
+}
+
+func GetConfig() *WebhookConfig {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current
+}
+
+func GetPlacement() PlacementConfig {
+	return GetConfig().Placement
 }
 
 func GetNamespace() string {
-	return namespace
+	return GetConfig().Server.Namespace
 }
 
 func GetServiceName() string {
-	return serviceName
+	return GetConfig().Registration.ServiceName
 }
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *WebhookConfig)
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			modify: func(cfg *WebhookConfig) {},
+		},
+		{
+			name:    "wrong kind",
+			modify:  func(cfg *WebhookConfig) { cfg.Kind = "Other" },
+			wantErr: true,
+		},
+		{
+			name:    "no namespace",
+			modify:  func(cfg *WebhookConfig) { cfg.Server.Namespace = "" },
+			wantErr: true,
+		},
+		{
+			name: "critical longer than warning",
+			modify: func(cfg *WebhookConfig) {
+				cfg.TLS.CriticalThreshold = v1.Duration{Duration: 2 * time.Hour}
+				cfg.TLS.WarningThreshold = v1.Duration{Duration: time.Hour}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "service port out of range",
+			modify:  func(cfg *WebhookConfig) { cfg.Registration.ServicePort = 70000 },
+			wantErr: true,
+		},
+		{
+			name:    "no rebalance evictions",
+			modify:  func(cfg *WebhookConfig) { cfg.Rebalance.EvictionsPerMinute = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "negative budget",
+			modify:  func(cfg *WebhookConfig) { cfg.Budget.CPU = "-1" },
+			wantErr: true,
+		},
+		{
+			name: "duplicate budget namespace",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Budget.Namespaces = []NamespaceBudgetConfig{{Namespace: "a"}, {Namespace: "a"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "namespace budgets",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Budget.Namespaces = []NamespaceBudgetConfig{{Namespace: "a", BudgetLimit: BudgetLimit{MaxPods: 3}}, {Namespace: "b", Priority: 1}}
+			},
+		},
+		{
+			name: "priority class for an unknown tier",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Priority.Classes = []PriorityClassConfig{{Tier: "reserved", Name: "reserved"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "priority class twice for a tier",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Priority.Classes = []PriorityClassConfig{{Tier: CapacitySpot, Name: "a"}, {Tier: CapacitySpot, Name: "b"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "normalizer rule with label and instance types",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Normalizer.Rules = []CapacityRule{{Label: "lifecycle", Regex: "spot", InstanceTypes: []string{"m5.large"}, Capacity: CapacitySpot}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "normalizer rule with invalid regex",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Normalizer.Rules = []CapacityRule{{Label: "lifecycle", Regex: "(", Capacity: CapacitySpot}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "same capacity values",
+			modify:  func(cfg *WebhookConfig) { cfg.Placement.SpotValue = cfg.Placement.OnDemandValue },
+			wantErr: true,
+		},
+		{
+			name: "tiers without spot",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Placement.Tiers = []TierConfig{{Name: CapacityOnDemand, NodeSelector: map[string]string{"a": "b"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "quota on the on-demand tier",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Placement.Tiers = []TierConfig{
+					{Name: CapacityOnDemand, NodeSelector: map[string]string{"a": "b"}, Quota: "1"},
+					{Name: CapacitySpot, NodeSelector: map[string]string{"a": "c"}},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "fallback to an unknown tier",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Placement.Tiers = []TierConfig{
+					{Name: CapacityOnDemand, NodeSelector: map[string]string{"a": "b"}},
+					{Name: CapacitySpot, NodeSelector: map[string]string{"a": "c"}, Fallback: []string{"reserved"}},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "spread with an unknown whenUnsatisfiable",
+			modify: func(cfg *WebhookConfig) {
+				cfg.Placement.SpotSpread = []SpreadConstraint{{MaxSkew: 1, TopologyKey: "zone", WhenUnsatisfiable: "Never"}}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuotaOf(t *testing.T) {
+	tests := []struct {
+		quota       string
+		replicas    int
+		want        int
+		wantLimited bool
+		wantErr     bool
+	}{
+		{quota: "", replicas: 10},
+		{quota: "3", replicas: 10, want: 3, wantLimited: true},
+		{quota: "0", replicas: 10, want: 0, wantLimited: true},
+		{quota: "50%", replicas: 10, want: 5, wantLimited: true},
+		{quota: "50%", replicas: 3, want: 2, wantLimited: true},
+		{quota: "10%", replicas: 1, want: 1, wantLimited: true},
+		{quota: "0%", replicas: 10, want: 0, wantLimited: true},
+		{quota: "100%", replicas: 7, want: 7, wantLimited: true},
+		{quota: "101%", wantErr: true},
+		{quota: "-1", wantErr: true},
+		{quota: "half", wantErr: true},
+	}
+	for _, tt := range tests {
+		tier := TierConfig{Name: "reserved", Quota: tt.quota}
+		got, limited, err := tier.QuotaOf(tt.replicas)
+		if (err != nil) != tt.wantErr || got != tt.want || limited != tt.wantLimited {
+			t.Errorf("QuotaOf(%d) with quota %q = %d, %v, %v, want %d, %v, wantErr %v",
+				tt.replicas, tt.quota, got, limited, err, tt.want, tt.wantLimited, tt.wantErr)
+		}
+	}
+}
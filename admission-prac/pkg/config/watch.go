@@ -0,0 +1,57 @@
+package config
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// editors and configmap updates touch the file several times in a row, reload once they settle
+	reloadDelay = time.Second
+)
+
+// Watch calls reload whenever the config file changes, until stopCh is closed.
+// The directory is watched rather than the file, a mounted configmap swaps a symlink instead of writing the file
+func Watch(path string, reload func(), stopCh <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Error("create config watcher err")
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		logrus.WithField("dir", dir).WithError(err).Error("watch config dir err")
+		return
+	}
+	logrus.WithField("path", path).Debug("watching config file")
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			logrus.WithField("event", event.String()).Debug("config dir changed")
+			timer = time.After(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Warn("config watcher err")
+		case <-timer:
+			timer = nil
+			reload()
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"practices/admission-prac/pkg/config"
+	"practices/admission-prac/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// capacityUnknown is reported for nodes without a known capacity label
+	capacityUnknown = "unknown"
+	// auditDecisionTTL is how long a decision waits for its pod, like budgetReservationTTL
+	auditDecisionTTL = time.Minute
+)
+
+type auditDecision struct {
+	Kind NodeKind
+	// Compared is set once the node the pod landed on was checked against the decision
+	Compared bool
+}
+
+// pendingAuditDecision is a decision of an admitted pod the informer has not seen yet
+type pendingAuditDecision struct {
+	ReplicasetUID types.UID
+	Kind          NodeKind
+	Expires       time.Time
+}
+
+var (
+	auditLock sync.Mutex
+	// pendingAuditDecisions are decisions of admitted pods without a name yet, per replicaset in admission order.
+	// A pod created with generateName has no name or uid at admission, so new pods of the replicaset take them in turn
+	pendingAuditDecisions = make(map[types.UID][]pendingAuditDecision)
+	// namedAuditDecisions are decisions of admitted pods that already had a name, by namespace/name
+	namedAuditDecisions = make(map[string]pendingAuditDecision)
+	auditDecisions      = make(map[types.UID]*auditDecision)
+	nodeLister          listersv1.NodeLister
+)
+
+// recordAuditDecision keeps the decision until the informer sees the pod, or until auditDecisionTTL
+// when the pod is never created, like when a later admission denies it
+func recordAuditDecision(replicasetUID types.UID, namespace, name string, kind NodeKind) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	decision := pendingAuditDecision{ReplicasetUID: replicasetUID, Kind: kind, Expires: time.Now().Add(auditDecisionTTL)}
+	if name != "" {
+		namedAuditDecisions[namespace+"/"+name] = decision
+		return
+	}
+	pendingAuditDecisions[replicasetUID] = append(pendingAuditDecisions[replicasetUID], decision)
+}
+
+// expireAuditDecisions drops the pending decisions whose pod never showed up, auditLock must be held
+func expireAuditDecisions(now time.Time) {
+	for replicasetUID, pending := range pendingAuditDecisions {
+		kept := pending[:0]
+		for _, decision := range pending {
+			if now.Before(decision.Expires) {
+				kept = append(kept, decision)
+			}
+		}
+		if len(kept) == 0 {
+			delete(pendingAuditDecisions, replicasetUID)
+			continue
+		}
+		pendingAuditDecisions[replicasetUID] = kept
+	}
+	for key, decision := range namedAuditDecisions {
+		if !now.Before(decision.Expires) {
+			delete(namedAuditDecisions, key)
+		}
+	}
+}
+
+// auditedTierPods counts the decisions per tier of the replicaset pods and of those still to come
+func auditedTierPods(replicasetUID types.UID, podCachemap PodCachemap) map[NodeKind]int {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	expireAuditDecisions(time.Now())
+	tierPods := make(map[NodeKind]int)
+	for _, decision := range pendingAuditDecisions[replicasetUID] {
+		tierPods[decision.Kind]++
+	}
+	for _, decision := range namedAuditDecisions {
+		if decision.ReplicasetUID == replicasetUID {
+			tierPods[decision.Kind]++
+		}
+	}
+	for uid, pod := range podCachemap {
+		if !podIsLive(pod) {
+			continue
+		}
+		if decision, ok := auditDecisions[uid]; ok {
+			tierPods[decision.Kind]++
+		}
+	}
+	return tierPods
+}
+
+// observeAuditedPod hands the pending decision to a new pod, by its name when it had one at admission,
+// and once the pod is scheduled compares the capacity of its node with the decision
+func observeAuditedPod(replicasetUID types.UID, pod *corev1.Pod) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	decision, ok := auditDecisions[pod.UID]
+	if !ok {
+		expireAuditDecisions(time.Now())
+		key := pod.Namespace + "/" + pod.Name
+		if named, ok := namedAuditDecisions[key]; ok {
+			delete(namedAuditDecisions, key)
+			decision = &auditDecision{Kind: named.Kind}
+		} else {
+			pending := pendingAuditDecisions[replicasetUID]
+			if len(pending) == 0 || pod.Spec.NodeName != "" {
+				return
+			}
+			decision = &auditDecision{Kind: pending[0].Kind}
+			if len(pending) == 1 {
+				delete(pendingAuditDecisions, replicasetUID)
+			} else {
+				pendingAuditDecisions[replicasetUID] = pending[1:]
+			}
+		}
+		auditDecisions[pod.UID] = decision
+	}
+	if decision.Compared || pod.Spec.NodeName == "" {
+		return
+	}
+	decision.Compared = true
+	actual := nodeCapacityOf(pod.Spec.NodeName)
+	metrics.AuditDecisions.WithLabelValues(string(decision.Kind), actual).Inc()
+	if actual != string(decision.Kind) {
+		metrics.AuditMismatches.Inc()
+		logrus.WithFields(logrus.Fields{
+			"pod":     pod.Namespace + "/" + pod.Name,
+			"node":    pod.Spec.NodeName,
+			"decided": decision.Kind,
+			"actual":  actual,
+		}).Info("audited pod landed on another capacity than decided")
+	}
+}
+
+func forgetAuditedPod(podUID types.UID) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	delete(auditDecisions, podUID)
+}
+
+func forgetAuditedReplicaset(replicasetUID types.UID) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	delete(pendingAuditDecisions, replicasetUID)
+	for key, decision := range namedAuditDecisions {
+		if decision.ReplicasetUID == replicasetUID {
+			delete(namedAuditDecisions, key)
+		}
+	}
+}
+
+func nodeCapacityOf(nodeName string) string {
+	if nodeLister == nil {
+		return capacityUnknown
+	}
+	node, err := nodeLister.Get(nodeName)
+	if err != nil {
+		logrus.WithField("node", nodeName).WithError(err).Debug("get node from cache err")
+		return capacityUnknown
+	}
+	if kind, ok := nodeTierOf(node.Labels, config.GetPlacement()); ok {
+		return string(kind)
+	}
+	return capacityUnknown
+}
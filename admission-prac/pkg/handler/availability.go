@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	availabilityLock sync.RWMutex
+	// availableNodes holds the labels of every Ready, schedulable node not being interrupted,
+	// the capacity is read from them on use as the capacity label may change live
+	availableNodes = make(map[string]map[string]string)
+)
+
+func nodeIsAvailable(node *corev1.Node, interrupted bool) bool {
+	if interrupted || node.Spec.Unschedulable {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func observeNodeAvailability(node *corev1.Node, interrupted bool) {
+	availabilityLock.Lock()
+	defer availabilityLock.Unlock()
+	if nodeIsAvailable(node, interrupted) {
+		availableNodes[node.Name] = node.Labels
+	} else {
+		delete(availableNodes, node.Name)
+	}
+}
+
+func forgetNodeAvailability(nodeName string) {
+	availabilityLock.Lock()
+	defer availabilityLock.Unlock()
+	delete(availableNodes, nodeName)
+}
+
+// availableNodeCount counts the available nodes of the kind, in the zone unless it is empty
+func availableNodeCount(kind NodeKind, zone string) int {
+	tier, ok := tierOf(config.GetPlacement(), kind)
+	if !ok {
+		return 0
+	}
+	availabilityLock.RLock()
+	defer availabilityLock.RUnlock()
+	count := 0
+	for _, labels := range availableNodes {
+		if !tierMatches(tier, labels) {
+			continue
+		}
+		if zone != "" && labels[corev1.LabelTopologyZone] != zone {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// podZoneOf is the zone the pod is pinned to by its node selector, if any
+func podZoneOf(pod corev1.Pod) string {
+	if zone, ok := pod.Spec.NodeSelector[corev1.LabelTopologyZone]; ok {
+		return zone
+	}
+	return pod.Spec.NodeSelector[corev1.LabelFailureDomainBetaZone]
+}
+
+// availableKindOf returns the first fallback tier with an available node when the chosen one has none,
+// the message tells what was found missing and is empty when the chosen kind is fine
+func availableKindOf(kind NodeKind, zone string) (NodeKind, string) {
+	placement := config.GetPlacement()
+	// before the sync no node is known, everything would look unavailable
+	if !placement.CapacityFallback || !hasInformersSynced() {
+		return kind, ""
+	}
+	if availableNodeCount(kind, zone) > 0 {
+		return kind, ""
+	}
+	where := "the cluster"
+	if zone != "" {
+		where = "zone " + zone
+	}
+	tier, _ := tierOf(placement, kind)
+	for _, fallback := range tier.Fallback {
+		if availableNodeCount(NodeKind(fallback), zone) > 0 {
+			return NodeKind(fallback), fmt.Sprintf("no ready schedulable %s node in %s, pod sent to %s nodes instead", kind, where, fallback)
+		}
+	}
+	if len(tier.Fallback) == 0 {
+		return kind, fmt.Sprintf("no ready schedulable %s node in %s, the pod may stay pending", kind, where)
+	}
+	return kind, fmt.Sprintf("no ready schedulable %s node or node of its fallbacks %s in %s, the pod may stay pending",
+		kind, strings.Join(tier.Fallback, ", "), where)
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	reasonBudgetExhausted = "OnDemandBudgetExhausted"
+	// budgetReservationTTL is how long an admitted pod holds its usage when the informer never sees it,
+	// like when a later webhook or the apiserver rejects it
+	budgetReservationTTL = time.Minute
+)
+
+type BudgetStatusParameters struct {
+	Name      string
+	Namespace string
+	Interval  time.Duration
+}
+
+var (
+	forceBudgetStatusApply = true
+	// budgetLock makes checking and reserving the budget one step, a scale up admits many pods at once
+	budgetLock sync.Mutex
+	// budgetReservations holds the usage of admitted on-demand pods per replicaset until the informer sees them
+	budgetReservationsLock sync.Mutex
+	budgetReservations     = make(map[types.UID][]budgetReservation)
+)
+
+type budgetReservation struct {
+	Namespace string
+	Usage     budgetUsage
+	Expires   time.Time
+}
+
+// budgetUsage is what on-demand pods take of a budget
+type budgetUsage struct {
+	Pods   int64
+	CPU    resource.Quantity
+	Memory resource.Quantity
+}
+
+// copy is needed before adding to a usage kept elsewhere, quantities may share their decimals
+func (u budgetUsage) copy() budgetUsage {
+	return budgetUsage{Pods: u.Pods, CPU: u.CPU.DeepCopy(), Memory: u.Memory.DeepCopy()}
+}
+
+func (u *budgetUsage) add(other budgetUsage) {
+	u.Pods += other.Pods
+	u.CPU.Add(other.CPU)
+	u.Memory.Add(other.Memory)
+}
+
+func usageOf(pod corev1.Pod) budgetUsage {
+	usage := budgetUsage{Pods: 1}
+	for _, container := range pod.Spec.Containers {
+		usage.CPU.Add(container.Resources.Requests[corev1.ResourceCPU])
+		usage.Memory.Add(container.Resources.Requests[corev1.ResourceMemory])
+	}
+	return usage
+}
+
+// budgetLimit is a parsed config.BudgetLimit, nil quantities have no cap
+type budgetLimit struct {
+	Pods   int64
+	CPU    *resource.Quantity
+	Memory *resource.Quantity
+}
+
+func limitOf(limit config.BudgetLimit) budgetLimit {
+	parsed := budgetLimit{Pods: limit.MaxPods}
+	// validated with the config
+	if limit.CPU != "" {
+		cpu := resource.MustParse(limit.CPU)
+		parsed.CPU = &cpu
+	}
+	if limit.Memory != "" {
+		memory := resource.MustParse(limit.Memory)
+		parsed.Memory = &memory
+	}
+	return parsed
+}
+
+// exceededBy tells which caps the usage is over, empty when it fits
+func (l budgetLimit) exceededBy(usage budgetUsage) string {
+	exceeded := []string{}
+	if l.Pods > 0 && usage.Pods > l.Pods {
+		exceeded = append(exceeded, fmt.Sprintf("pods %d of %d", usage.Pods, l.Pods))
+	}
+	if l.CPU != nil && usage.CPU.Cmp(*l.CPU) > 0 {
+		exceeded = append(exceeded, fmt.Sprintf("cpu %s of %s", usage.CPU.String(), l.CPU.String()))
+	}
+	if l.Memory != nil && usage.Memory.Cmp(*l.Memory) > 0 {
+		exceeded = append(exceeded, fmt.Sprintf("memory %s of %s", usage.Memory.String(), l.Memory.String()))
+	}
+	return strings.Join(exceeded, ", ")
+}
+
+// unused is what is left of the caps, nothing is left of what has no cap
+func (l budgetLimit) unused(usage budgetUsage) budgetUsage {
+	left := budgetUsage{}
+	if l.Pods > usage.Pods {
+		left.Pods = l.Pods - usage.Pods
+	}
+	if l.CPU != nil && l.CPU.Cmp(usage.CPU) > 0 {
+		left.CPU = l.CPU.DeepCopy()
+		left.CPU.Sub(usage.CPU)
+	}
+	if l.Memory != nil && l.Memory.Cmp(usage.Memory) > 0 {
+		left.Memory = l.Memory.DeepCopy()
+		left.Memory.Sub(usage.Memory)
+	}
+	return left
+}
+
+func (l budgetLimit) describe(usage budgetUsage) string {
+	capOf := func(set bool, value string) string {
+		if !set {
+			return "-"
+		}
+		return value
+	}
+	return fmt.Sprintf("pods %d/%s, cpu %s/%s, memory %s/%s",
+		usage.Pods, capOf(l.Pods > 0, fmt.Sprint(l.Pods)),
+		usage.CPU.String(), capOf(l.CPU != nil, quantityString(l.CPU)),
+		usage.Memory.String(), capOf(l.Memory != nil, quantityString(l.Memory)))
+}
+
+func quantityString(quantity *resource.Quantity) string {
+	if quantity == nil {
+		return ""
+	}
+	return quantity.String()
+}
+
+// onDemandUsage sums the live on-demand pods the informer has seen, over the cluster and per namespace.
+// Pods on a node being interrupted are not counted, their replacements take their place
+func onDemandUsage() (budgetUsage, map[string]budgetUsage) {
+	placement := config.GetPlacement()
+	cluster := budgetUsage{}
+	namespaces := make(map[string]budgetUsage)
+	replicasetCacheLock.RLock()
+	defer replicasetCacheLock.RUnlock()
+	for _, podCachemap := range replicasetCache {
+		for _, pod := range podCachemap {
+			if !podIsLive(pod) || isNodeInterrupted(pod.Spec.NodeName) || !podHasOnDemandNodeAffinity(pod, placement) {
+				continue
+			}
+			usage := usageOf(pod)
+			cluster.add(usage)
+			namespaceUsage := namespaces[pod.Namespace].copy()
+			namespaceUsage.add(usage)
+			namespaces[pod.Namespace] = namespaceUsage
+		}
+	}
+	for _, reservation := range liveBudgetReservations() {
+		cluster.add(reservation.Usage)
+		namespaceUsage := namespaces[reservation.Namespace].copy()
+		namespaceUsage.add(reservation.Usage)
+		namespaces[reservation.Namespace] = namespaceUsage
+	}
+	return cluster, namespaces
+}
+
+// liveBudgetReservations drops the expired reservations and returns the others
+func liveBudgetReservations() []budgetReservation {
+	budgetReservationsLock.Lock()
+	defer budgetReservationsLock.Unlock()
+	now := time.Now()
+	live := []budgetReservation{}
+	for replicasetUID, reservations := range budgetReservations {
+		kept := reservations[:0]
+		for _, reservation := range reservations {
+			if now.Before(reservation.Expires) {
+				kept = append(kept, reservation)
+			}
+		}
+		if len(kept) == 0 {
+			delete(budgetReservations, replicasetUID)
+			continue
+		}
+		budgetReservations[replicasetUID] = kept
+		live = append(live, kept...)
+	}
+	return live
+}
+
+// reserveOnDemandBudget is onDemandBudgetProblem for a pod being admitted, when the budget has room
+// the pod's usage is held until the informer sees the pod or releaseOnDemandBudget gives it back
+func reserveOnDemandBudget(replicasetUID types.UID, namespace string, pod corev1.Pod) string {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if problem := onDemandBudgetProblem(namespace, pod); problem != "" || !config.GetConfig().Budget.Enabled {
+		return problem
+	}
+	budgetReservationsLock.Lock()
+	defer budgetReservationsLock.Unlock()
+	budgetReservations[replicasetUID] = append(budgetReservations[replicasetUID], budgetReservation{
+		Namespace: namespace,
+		Usage:     usageOf(pod),
+		Expires:   time.Now().Add(budgetReservationTTL),
+	})
+	return ""
+}
+
+// releaseOnDemandBudget gives back the oldest reservation of the replicaset, once its pod is counted
+// by the informer or when the pod did not go to on-demand after all
+func releaseOnDemandBudget(replicasetUID types.UID) {
+	budgetReservationsLock.Lock()
+	defer budgetReservationsLock.Unlock()
+	reservations := budgetReservations[replicasetUID]
+	if len(reservations) <= 1 {
+		delete(budgetReservations, replicasetUID)
+		return
+	}
+	budgetReservations[replicasetUID] = reservations[1:]
+}
+
+// onDemandBudgetProblem tells why the pod can not go to on-demand, empty when the budget has room for it
+func onDemandBudgetProblem(namespace string, pod corev1.Pod) string {
+	budget := config.GetConfig().Budget
+	if !budget.Enabled {
+		return ""
+	}
+	cluster, namespaces := onDemandUsage()
+	podUsage := usageOf(pod)
+
+	priority := 0
+	for _, namespaceBudget := range budget.Namespaces {
+		if namespaceBudget.Namespace != namespace {
+			continue
+		}
+		priority = namespaceBudget.Priority
+		usage := namespaces[namespace].copy()
+		usage.add(podUsage)
+		if exceeded := limitOf(namespaceBudget.BudgetLimit).exceededBy(usage); exceeded != "" {
+			return fmt.Sprintf("on-demand budget of namespace %s exhausted (%s), pod sent to spot nodes instead", namespace, exceeded)
+		}
+	}
+	// what namespaces with a higher priority may still use is held back
+	usage := cluster.copy()
+	usage.add(podUsage)
+	for _, namespaceBudget := range budget.Namespaces {
+		if namespaceBudget.Priority > priority && namespaceBudget.Namespace != namespace {
+			usage.add(limitOf(namespaceBudget.BudgetLimit).unused(namespaces[namespaceBudget.Namespace]))
+		}
+	}
+	if exceeded := limitOf(budget.BudgetLimit).exceededBy(usage); exceeded != "" {
+		return fmt.Sprintf("cluster on-demand budget exhausted (%s, including the share held for higher priority namespaces), pod sent to spot nodes instead", exceeded)
+	}
+	return ""
+}
+
+// StartBudgetStatus writes the on-demand budget usage to a configmap until stopCh is closed
+func StartBudgetStatus(parameters BudgetStatusParameters, stopCh <-chan struct{}) {
+	logrus.Println("starting on-demand budget status")
+	if err := wait.PollImmediateUntil(time.Second, func() (bool, error) { return hasInformersSynced(), nil }, stopCh); err != nil {
+		logrus.Debug("on-demand budget status stopped before informers synced")
+		return
+	}
+	wait.Until(func() {
+		if err := applyBudgetStatus(parameters); err != nil {
+			logrus.WithError(err).Warn("write on-demand budget status err")
+		}
+	}, parameters.Interval, stopCh)
+	logrus.Debug("on-demand budget status stopped")
+}
+
+func applyBudgetStatus(parameters BudgetStatusParameters) error {
+	budget := config.GetConfig().Budget
+	cluster, namespaces := onDemandUsage()
+	data := map[string]string{
+		"cluster":   limitOf(budget.BudgetLimit).describe(cluster),
+		"updatedAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	limits := make(map[string]budgetLimit)
+	for _, namespaceBudget := range budget.Namespaces {
+		limits[namespaceBudget.Namespace] = limitOf(namespaceBudget.BudgetLimit)
+		if _, ok := namespaces[namespaceBudget.Namespace]; !ok {
+			namespaces[namespaceBudget.Namespace] = budgetUsage{}
+		}
+	}
+	for namespace, usage := range namespaces {
+		data["namespace."+namespace] = limits[namespace].describe(usage)
+	}
+
+	configMap := &corev1.ConfigMap{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.Name,
+			Namespace: parameters.Namespace,
+		},
+		Data: data,
+	}
+	body, err := json.Marshal(configMap)
+	if err != nil {
+		return err
+	}
+	_, err = clientset.GetClientset().CoreV1().ConfigMaps(parameters.Namespace).Patch(context.TODO(), parameters.Name, types.ApplyPatchType, body, v1.PatchOptions{
+		FieldManager: "admission-prac",
+		Force:        &forceBudgetStatusApply,
+	})
+	return err
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func usage(pods int64, cpu, memory string) budgetUsage {
+	return budgetUsage{Pods: pods, CPU: resource.MustParse(cpu), Memory: resource.MustParse(memory)}
+}
+
+func TestExceededBy(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit config.BudgetLimit
+		usage budgetUsage
+		want  string
+	}{
+		{
+			name:  "no caps",
+			usage: usage(100, "100", "100Gi"),
+		},
+		{
+			name:  "at the caps",
+			limit: config.BudgetLimit{MaxPods: 2, CPU: "2", Memory: "2Gi"},
+			usage: usage(2, "2000m", "2Gi"),
+		},
+		{
+			name:  "over the pods",
+			limit: config.BudgetLimit{MaxPods: 2},
+			usage: usage(3, "0", "0"),
+			want:  "pods 3 of 2",
+		},
+		{
+			name:  "over cpu and memory",
+			limit: config.BudgetLimit{MaxPods: 10, CPU: "1", Memory: "1Gi"},
+			usage: usage(3, "1500m", "2Gi"),
+			want:  "cpu 1500m of 1, memory 2Gi of 1Gi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := limitOf(tt.limit).exceededBy(tt.usage); got != tt.want {
+				t.Errorf("exceededBy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnused(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit config.BudgetLimit
+		usage budgetUsage
+		want  budgetUsage
+	}{
+		{
+			name:  "no caps leave nothing",
+			usage: usage(1, "1", "1Gi"),
+			want:  usage(0, "0", "0"),
+		},
+		{
+			name:  "left of the caps",
+			limit: config.BudgetLimit{MaxPods: 3, CPU: "2", Memory: "2Gi"},
+			usage: usage(1, "500m", "1Gi"),
+			want:  usage(2, "1500m", "1Gi"),
+		},
+		{
+			name:  "over the caps leaves nothing",
+			limit: config.BudgetLimit{MaxPods: 1, CPU: "1"},
+			usage: usage(2, "2", "0"),
+			want:  usage(0, "0", "0"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := limitOf(tt.limit).unused(tt.usage)
+			if got.Pods != tt.want.Pods || got.CPU.Cmp(tt.want.CPU) != 0 || got.Memory.Cmp(tt.want.Memory) != 0 {
+				t.Errorf("unused() = %s, want %s", limitOf(config.BudgetLimit{}).describe(got), limitOf(config.BudgetLimit{}).describe(tt.want))
+			}
+		})
+	}
+}
+
+func onDemandPod(namespace, name string, placement config.PlacementConfig) corev1.Pod {
+	affinity := nodeAffinityOf(NodeOnDemand, placement)
+	return corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(namespace + "/" + name)},
+		Spec: corev1.PodSpec{
+			Affinity: &corev1.Affinity{NodeAffinity: &affinity},
+			Containers: []corev1.Container{
+				{
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestOnDemandBudgetProblem(t *testing.T) {
+	cfg := config.Default()
+	cfg.Budget.Enabled = true
+	cfg.Budget.MaxPods = 4
+	cfg.Budget.Namespaces = []config.NamespaceBudgetConfig{
+		{Namespace: "high", BudgetLimit: config.BudgetLimit{MaxPods: 2}, Priority: 10},
+		{Namespace: "low", BudgetLimit: config.BudgetLimit{MaxPods: 3}},
+		{Namespace: "cpu", BudgetLimit: config.BudgetLimit{CPU: "1"}, Priority: 10},
+	}
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	tests := []struct {
+		name      string
+		namespace string
+		// running is how many on-demand pods each namespace already has
+		running     map[string]int
+		wantProblem bool
+	}{
+		{
+			name:      "room in the cluster",
+			namespace: "other",
+		},
+		{
+			name:        "namespace cap reached",
+			namespace:   "high",
+			running:     map[string]int{"high": 2},
+			wantProblem: true,
+		},
+		{
+			name:        "namespace cpu cap reached",
+			namespace:   "cpu",
+			running:     map[string]int{"cpu": 2},
+			wantProblem: true,
+		},
+		{
+			name:      "higher priority namespace uses the cluster cap left",
+			namespace: "high",
+			running:   map[string]int{"low": 3},
+		},
+		{
+			name:        "unused share of a higher priority namespace is held back",
+			namespace:   "low",
+			running:     map[string]int{"low": 2},
+			wantProblem: true,
+		},
+		{
+			name:      "used share of a higher priority namespace is not held back",
+			namespace: "low",
+			running:   map[string]int{"low": 1, "high": 2},
+		},
+		{
+			name:        "cluster cap reached",
+			namespace:   "other",
+			running:     map[string]int{"other": 4},
+			wantProblem: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podCachemap := make(PodCachemap)
+			for namespace, pods := range tt.running {
+				for n := 0; n < pods; n++ {
+					pod := onDemandPod(namespace, fmt.Sprintf("running-%d", n), cfg.Placement)
+					podCachemap[pod.UID] = pod
+				}
+			}
+			replicasetCacheLock.Lock()
+			replicasetCache = map[types.UID]PodCachemap{"replicaset": podCachemap}
+			replicasetCacheLock.Unlock()
+
+			problem := onDemandBudgetProblem(tt.namespace, onDemandPod(tt.namespace, "new", cfg.Placement))
+			if (problem != "") != tt.wantProblem {
+				t.Errorf("onDemandBudgetProblem() = %q, wantProblem %v", problem, tt.wantProblem)
+			}
+		})
+	}
+	replicasetCacheLock.Lock()
+	replicasetCache = make(map[types.UID]PodCachemap)
+	replicasetCacheLock.Unlock()
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -23,19 +26,39 @@ var (
 	Organization = "noorganization"
 	// Organization      = "noorganization.io"
 	DefaultEffecttime = 10
-	// dnsNames          = []string{webhookService, webhookService + "." + webhookNamespace, webhookService + "." + webhookNamespace + "." + "svc"}
-	dnsNames = []string{config.GetServiceName(), config.GetServiceName() + "." + config.GetNamespace(), config.GetServiceName() + "." + config.GetNamespace() + "." + "svc"}
-	// commonName        = webhookService + "." + webhookNamespace + "." + "svc"
-	commonName = config.GetServiceName() + "." + config.GetNamespace() + "." + "svc"
-	certsDir   = "/etc/webhook/certs"
-	certKey    = "tls.key"
-	certFile   = "tls.crt"
+	certsDir          = "/etc/webhook/certs"
+	certKey           = "tls.key"
+	certFile          = "tls.crt"
+	// certsMarker is written next to the certs HandleCerts generated, only those are removed again,
+	// never certs mounted from a secret or put there by someone else
+	certsMarker = ".generated-by-admission-prac"
+	// extraHosts are added to the serving cert besides the service names, e.g. the host of the dev mode url
+	extraHosts = []string{}
 )
 
+func SetCertsDir(dir string) {
+	certsDir = dir
+}
+
+// AddCertHost adds a host name or IP the serving cert must be valid for
+func AddCertHost(host string) {
+	extraHosts = append(extraHosts, host)
+}
+
+// dnsNames and commonName are built on use, config is not set yet when package vars are initialized
+func dnsNames() []string {
+	return []string{config.GetServiceName(), config.GetServiceName() + "." + config.GetNamespace(), config.GetServiceName() + "." + config.GetNamespace() + "." + "svc"}
+}
+
+func commonName() string {
+	return config.GetServiceName() + "." + config.GetNamespace() + "." + "svc"
+}
+
 type certManager struct {
 	Organizations []string      `json:"organizations"`
 	EffectiveTime time.Duration `json:"effectiveTime"`
 	DNSNames      []string      `json:"DNSNames"`
+	IPAddresses   []net.IP      `json:"IPAddresses"`
 	CommonName    string        `json:"commonName"`
 }
 
@@ -52,13 +75,35 @@ func NewCertManager(
 	}
 }
 
-func HandleCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buffer, err error) {
-	serverCertPEM, serverPrivateKeyPEM, err = NewCertManager(
+// GenerateCerts generates a self signed serving cert and key for the configured service without writing them
+func GenerateCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buffer, err error) {
+	names := dnsNames()
+	ips := []net.IP{}
+	for _, host := range extraHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, host)
+		}
+	}
+	m := NewCertManager(
 		[]string{Organization},
 		time.Until(time.Date(time.Now().Year()+DefaultEffecttime, time.Now().Month(), time.Now().Day(), time.Now().Hour(), time.Now().Minute(), 0, 0, time.Now().Location())),
-		dnsNames,
-		commonName,
-	).GenerateSelfSignedCerts()
+		names,
+		commonName(),
+	)
+	m.IPAddresses = ips
+	return m.GenerateSelfSignedCerts()
+}
+
+func HandleCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buffer, err error) {
+	// certs mounted from a secret, e.g. the one from the render command, are used as they are
+	if serverCertPEM, serverPrivateKeyPEM, err = loadCerts(); err == nil {
+		logrus.WithField("certDir", certsDir).Println("using existing certs")
+		return
+	}
+
+	serverCertPEM, serverPrivateKeyPEM, err = GenerateCerts()
 	if err != nil {
 		logrus.WithError(err).Error("failed to generate certs")
 		// return err
@@ -86,6 +131,12 @@ func HandleCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buff
 		return
 	}
 
+	err = WriteFile(filepath.Join(certsDir, certsMarker), bytes.NewBufferString("certs in this dir were generated by admission-prac and are removed on uninstall\n"))
+	if err != nil {
+		logrus.WithField("certDir", certsDir).WithError(err).Error("failed to write certs marker")
+		return
+	}
+
 	// if err = CreateAdmissionConfig(serverCertPEM); err != nil {
 	// 	log.WithField("tls.cert", serverCertPEM.String()).WithError(err).Error("failed to create admission config")
 	// 	return err
@@ -96,6 +147,37 @@ func HandleCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buff
 	return
 }
 
+func loadCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buffer, err error) {
+	certBytes, err := os.ReadFile(filepath.Join(certsDir, certFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBytes, err := os.ReadFile(filepath.Join(certsDir, certKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	pair, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		logrus.WithError(err).Warn("existing certs are invalid")
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		logrus.WithField("notAfter", leaf.NotAfter).Warn("existing certs expired")
+		return nil, nil, fmt.Errorf("existing cert expired at %v", leaf.NotAfter)
+	}
+	for _, host := range append(dnsNames(), extraHosts...) {
+		if err := leaf.VerifyHostname(host); err != nil {
+			logrus.WithField("host", host).Warn("existing certs do not cover host")
+			return nil, nil, err
+		}
+	}
+	return bytes.NewBuffer(certBytes), bytes.NewBuffer(keyBytes), nil
+}
+
 func (m *certManager) GenerateSelfSignedCerts() (serverCertPEM *bytes.Buffer, serverPrivateKeyPEM *bytes.Buffer, err error) {
 	// CA config
 	ca := &x509.Certificate{
@@ -136,6 +218,7 @@ func (m *certManager) GenerateSelfSignedCerts() (serverCertPEM *bytes.Buffer, se
 	// server cert config
 	cert := &x509.Certificate{
 		DNSNames:     m.DNSNames,
+		IPAddresses:  m.IPAddresses,
 		SerialNumber: big.NewInt(1658),
 		Subject: pkix.Name{
 			CommonName:   m.CommonName,
@@ -193,3 +276,32 @@ func WriteFile(filepath string, sCert *bytes.Buffer) error {
 
 	return nil
 }
+
+// RemoveCerts deletes the files written by HandleCerts and returns the removed paths,
+// with dryRun nothing is deleted and the returned paths are what would be removed.
+// Certs without the marker, like a mounted secret, were not generated by us and are left alone
+func RemoveCerts(dryRun bool) ([]string, error) {
+	removed := []string{}
+	markerPath := filepath.Join(certsDir, certsMarker)
+	if _, err := os.Stat(markerPath); err != nil {
+		logrus.WithField("certDir", certsDir).Debug("certs not generated by us, leaving them")
+		return removed, nil
+	}
+	// the marker goes last, a failed removal can be retried
+	for _, name := range []string{certFile, certKey, certsMarker} {
+		certPath := filepath.Join(certsDir, name)
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(certPath); err != nil {
+				logrus.WithField("path", certPath).WithError(err).Error("failed to remove cert file")
+				return removed, err
+			}
+		}
+		if name != certsMarker {
+			removed = append(removed, certPath)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"practices/admission-prac/pkg/recorder"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	reasonPlacedOnDemand         = "PlacedOnDemand"
+	reasonPlacedSpot             = "PlacedSpot"
+	reasonPlacedOnTier           = "PlacedOnTier"
+	reasonPlacementSkipped       = "PlacementSkipped"
+	reasonPlacementBeforeSync    = "PlacementDecidedBeforeSync"
+	reasonPlacementAnnotationBad = "InvalidPlacementAnnotation"
+	reasonCapacityUnavailable    = "CapacityUnavailable"
+	reasonRebalanceEvicted       = "RebalanceEvicted"
+	reasonRebalanceBlocked       = "RebalanceBlocked"
+)
+
+// eventTargetOf returns the object events about the pod are reported on,
+// the deployment of its replicaset when known, else its direct owner
+func eventTargetOf(pod corev1.Pod, namespace string) *corev1.ObjectReference {
+	if len(pod.OwnerReferences) == 0 {
+		return nil
+	}
+	ownerRef := pod.OwnerReferences[0]
+	if ownerRef.Kind == "ReplicaSet" {
+		if deployment, ok := getReplicasetDeployment(ownerRef.UID); ok {
+			return deploymentReferenceOf(deployment)
+		}
+	}
+	return &corev1.ObjectReference{
+		APIVersion: ownerRef.APIVersion,
+		Kind:       ownerRef.Kind,
+		Namespace:  namespace,
+		Name:       ownerRef.Name,
+		UID:        ownerRef.UID,
+	}
+}
+
+func deploymentReferenceOf(deployment deploymentOfReplicaset) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Namespace:  deployment.Namespace,
+		Name:       deployment.Name,
+		UID:        deployment.UID,
+	}
+}
+
+// recordPodEvent reports on the owner of the pod, pods without owner have nothing to report on
+func recordPodEvent(target *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if target == nil {
+		return
+	}
+	recorder.GetRecorder().Eventf(target, eventType, reason, messageFmt, args...)
+}
+
+func placedReasonOf(kind NodeKind) string {
+	switch kind {
+	case NodeOnDemand:
+		return reasonPlacedOnDemand
+	case NodeSpot:
+		return reasonPlacedSpot
+	}
+	return reasonPlacedOnTier
+}
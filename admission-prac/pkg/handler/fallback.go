@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	reasonSpotCapacityExhausted = "SpotCapacityExhausted"
+	reasonSpotCapacityReturned  = "SpotCapacityReturned"
+	reasonSpotFallbackRecreated = "SpotFallbackRecreated"
+)
+
+type FallbackParameters struct {
+	// Interval is how often all replicasets are checked, pod changes trigger a check right away
+	Interval time.Duration
+	// PendingTimeout is how long a spot pod may be unschedulable before its deployment is degraded
+	PendingTimeout time.Duration
+	// RetryAfter is how long a deployment stays degraded when no new spot node shows up
+	RetryAfter         time.Duration
+	EvictionsPerMinute int
+}
+
+var (
+	fallbackQueue = workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Second, 10*time.Minute), "fallback")
+	fallbackRunning int32
+)
+
+type fallback struct {
+	parameters      FallbackParameters
+	evictionLimiter flowcontrol.RateLimiter
+}
+
+// enqueueFallback asks the fallback controller to check the replicaset, it does nothing while the controller is off
+func enqueueFallback(replicasetUID types.UID) {
+	if atomic.LoadInt32(&fallbackRunning) == 1 {
+		fallbackQueue.Add(replicasetUID)
+	}
+}
+
+// StartFallback sends the pods of a deployment to on-demand nodes while its spot pods can not be scheduled,
+// and back to spot once spot capacity returns. It runs until stopCh is closed
+func StartFallback(parameters FallbackParameters, stopCh <-chan struct{}) {
+	logrus.Println("starting spot fallback")
+	f := &fallback{
+		parameters:      parameters,
+		evictionLimiter: flowcontrol.NewTokenBucketRateLimiter(float32(parameters.EvictionsPerMinute)/60, 1),
+	}
+	defer fallbackQueue.ShutDown()
+
+	if err := wait.PollImmediateUntil(time.Second, func() (bool, error) { return hasInformersSynced(), nil }, stopCh); err != nil {
+		logrus.Debug("spot fallback stopped before informers synced")
+		return
+	}
+	atomic.StoreInt32(&fallbackRunning, 1)
+
+	go wait.Until(func() {
+		for _, replicasetUID := range cachedReplicasets() {
+			fallbackQueue.Add(replicasetUID)
+		}
+	}, parameters.Interval, stopCh)
+	go wait.Until(f.runWorker, time.Second, stopCh)
+	<-stopCh
+	logrus.Debug("spot fallback stopped")
+}
+
+func (f *fallback) runWorker() {
+	for f.processNextItem() {
+	}
+}
+
+func (f *fallback) processNextItem() bool {
+	key, quit := fallbackQueue.Get()
+	if quit {
+		return false
+	}
+	defer fallbackQueue.Done(key)
+
+	replicasetUID := key.(types.UID)
+	requeueAfter, err := f.reconcile(replicasetUID)
+	if err != nil {
+		logrus.WithField("replicaset", replicasetUID).WithError(err).Warn("spot fallback of replicaset err, backing off")
+		fallbackQueue.AddRateLimited(key)
+		return true
+	}
+	fallbackQueue.Forget(key)
+	if requeueAfter > 0 {
+		fallbackQueue.AddAfter(key, requeueAfter)
+	}
+	return true
+}
+
+// reconcile marks the deployment degraded once a spot pod is unschedulable for longer than PendingTimeout,
+// then recreates its unschedulable spot pods, which the webhook admits as on-demand.
+// Once spot capacity is back the mark is removed and the fallback pods are evicted one by one
+func (f *fallback) reconcile(replicasetUID types.UID) (time.Duration, error) {
+	deployment, ok := getReplicasetDeployment(replicasetUID)
+	if !ok {
+		return 0, nil
+	}
+	pods := podsOfReplicaset(replicasetUID)
+	if len(pods) == 0 {
+		return 0, nil
+	}
+	deploymentAnnotations := getReplicasetDeploymentAnnotations(replicasetUID)
+	policy, _ := resolvePlacementPolicy(deployment.Namespace, deploymentAnnotations, pods[0].Annotations)
+	if policy.Mode == placementSkip || policy.Mode == placementAllOnDemand || policy.Audit {
+		return 0, nil
+	}
+	placement := config.GetPlacement()
+	target := deploymentReferenceOf(deployment)
+
+	if !policy.SpotDegraded {
+		stuck := 0
+		var oldest time.Duration
+		for _, pod := range pods {
+			if pending, ok := unschedulableFor(pod); ok && podIsLive(pod) && podHasSpotNodeAffinity(pod, placement) {
+				stuck++
+				if pending > oldest {
+					oldest = pending
+				}
+			}
+		}
+		if stuck == 0 {
+			return f.switchBack(replicasetUID, deployment, policy, pods)
+		}
+		if oldest < f.parameters.PendingTimeout {
+			return f.parameters.PendingTimeout - oldest, nil
+		}
+		if err := setSpotDegraded(deployment, true); err != nil {
+			return 0, err
+		}
+		logrus.WithField("deployment", deployment.key()).Warnf("%d spot pods unschedulable for %v, falling back to on-demand", stuck, oldest.Round(time.Second))
+		recordPodEvent(target, corev1.EventTypeWarning, reasonSpotCapacityExhausted,
+			"%d spot pods unschedulable for %v, new pods go to on-demand nodes until spot capacity returns", stuck, oldest.Round(time.Second))
+		// the stuck pods are recreated once the mark is in the cache, or their replacements would go to spot again
+		return 5 * time.Second, nil
+	}
+
+	since, err := time.Parse(time.RFC3339, deploymentAnnotations[SpotDegradedAnnotation])
+	if err != nil {
+		since = time.Time{}
+	}
+	if spotCapacityReturned(since) || time.Since(since) > f.parameters.RetryAfter {
+		if err := setSpotDegraded(deployment, false); err != nil {
+			return 0, err
+		}
+		logrus.WithField("deployment", deployment.key()).Println("spot capacity returned, back to spot")
+		recordPodEvent(target, corev1.EventTypeNormal, reasonSpotCapacityReturned, "spot capacity returned, new pods go to spot nodes again")
+		return f.parameters.Interval, nil
+	}
+
+	for _, pod := range pods {
+		if _, ok := unschedulableFor(pod); !ok || !podIsLive(pod) || !podHasSpotNodeAffinity(pod, placement) {
+			continue
+		}
+		// an unscheduled pod runs nothing, no poddisruptionbudget is involved in deleting it
+		err := clientset.GetClientset().CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, v1.DeleteOptions{
+			Preconditions: &v1.Preconditions{UID: &pod.UID},
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			return 0, fmt.Errorf("delete pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		recordPodEvent(target, corev1.EventTypeNormal, reasonSpotFallbackRecreated,
+			"recreating unschedulable spot pod %s on on-demand nodes", pod.Name)
+	}
+	return f.parameters.Interval, nil
+}
+
+// switchBack evicts one fallback pod at a time once the deployment is not degraded any more,
+// its replacement is admitted by the normal count. Only settled replicasets are touched
+func (f *fallback) switchBack(replicasetUID types.UID, deployment deploymentOfReplicaset, policy placementPolicy, pods []corev1.Pod) (time.Duration, error) {
+	replicas, ok := getReplicasetReplicas(replicasetUID)
+	if !ok {
+		return 0, nil
+	}
+	placement := config.GetPlacement()
+	livePods := []corev1.Pod{}
+	fallbackPods := []corev1.Pod{}
+	onDemandPods := 0
+	for _, pod := range pods {
+		if !podIsLive(pod) {
+			continue
+		}
+		if !podIsReady(pod) {
+			return 0, nil
+		}
+		livePods = append(livePods, pod)
+		if podHasOnDemandNodeAffinity(pod, placement) {
+			onDemandPods++
+			if pod.Annotations[PlacementSourceAnnotation] == string(sourceFallback) {
+				fallbackPods = append(fallbackPods, pod)
+			}
+		}
+	}
+	wantOnDemand := policy.onDemandWanted()
+	if len(fallbackPods) == 0 || len(livePods) != int(replicas) || onDemandPods <= wantOnDemand {
+		return 0, nil
+	}
+	if !f.evictionLimiter.TryAccept() {
+		return time.Minute / time.Duration(f.parameters.EvictionsPerMinute), nil
+	}
+	pod := fallbackPods[0]
+	eviction := &policyv1.Eviction{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	err := clientset.GetClientset().CoreV1().Pods(pod.Namespace).EvictV1(context.TODO(), eviction)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("evict fallback pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	recordPodEvent(deploymentReferenceOf(deployment), corev1.EventTypeNormal, reasonRebalanceEvicted,
+		"evicted fallback pod %s so its replacement goes back to spot nodes", pod.Name)
+	return f.parameters.Interval, nil
+}
+
+// unschedulableFor tells how long the scheduler has been failing to place the pod,
+// this condition comes with the FailedScheduling events of the scheduler
+func unschedulableFor(pod corev1.Pod) (time.Duration, bool) {
+	if pod.Spec.NodeName != "" {
+		return 0, false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable {
+			return time.Since(condition.LastTransitionTime.Time), true
+		}
+	}
+	return 0, false
+}
+
+// spotCapacityReturned tells if a spot node became ready and schedulable since the given time
+func spotCapacityReturned(since time.Time) bool {
+	if nodeLister == nil {
+		return false
+	}
+	tier, ok := tierOf(config.GetPlacement(), NodeSpot)
+	if !ok {
+		return false
+	}
+	nodes, err := nodeLister.List(labels.SelectorFromSet(labels.Set(tier.NodeSelector)))
+	if err != nil {
+		logrus.WithError(err).Warn("list spot nodes from cache err")
+		return false
+	}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue && condition.LastTransitionTime.Time.After(since) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setSpotDegraded sets or removes the degraded mark on the deployment, a json merge patch leaves other annotations alone
+func setSpotDegraded(deployment deploymentOfReplicaset, degraded bool) error {
+	value := "null"
+	if degraded {
+		value = fmt.Sprintf("%q", time.Now().UTC().Format(time.RFC3339))
+	}
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}}}`, SpotDegradedAnnotation, value)
+	_, err := clientset.GetClientset().AppsV1().Deployments(deployment.Namespace).Patch(context.TODO(), deployment.Name,
+		types.MergePatchType, []byte(patch), v1.PatchOptions{FieldManager: "admission-prac"})
+	if err != nil {
+		return fmt.Errorf("patch deployment %s: %v", deployment.key(), err)
+	}
+	return nil
+}
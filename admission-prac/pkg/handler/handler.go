@@ -2,11 +2,15 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
+	"practices/admission-prac/pkg/config"
+
 	"github.com/sirupsen/logrus"
 	admission "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
@@ -23,15 +27,20 @@ const (
 )
 
 var (
-	UniversalDeserializer      = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
-	nodeSelectorRequirementKey = "node.kubernetes.io/capacity"
+	UniversalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
 )
 
-type mutateHandler struct {
+// admissionHandler decodes the admission review and writes back what review returns
+type admissionHandler struct {
+	review func(admission.AdmissionReview) (admission.AdmissionReview, error)
 }
 
 func NewMutateHandler() http.Handler {
-	return &mutateHandler{}
+	return &admissionHandler{review: mutatePod}
+}
+
+func NewValidateHandler() http.Handler {
+	return &admissionHandler{review: validateDeployment}
 }
 
 type PatchOperation struct {
@@ -40,7 +49,7 @@ type PatchOperation struct {
 	Value     interface{} `json:"value,omitempty"`
 }
 
-func (h *mutateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *admissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	requestMark := rand.Int()
 	startTime := time.Now()
 	logrus.Debugf("requested, requestMark: %v, startTime: %v", requestMark, startTime)
@@ -69,22 +78,7 @@ func (h *mutateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raw := admissionReviewFromRequest.Request.Object.Raw
-	pod := corev1.Pod{}
-	if _, _, err := UniversalDeserializer.Decode(raw, nil, &pod); err != nil {
-		logrus.Errorf("decode object to pod err: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if podNotToHandle(pod) {
-		logrus.Errorf("pod not to handle: %v", pod.Name)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	nodeAffinity := setNodeAffinity(pod.OwnerReferences[0].UID)
-	// nodeAffinity := setNodeAffinity("aaa")
-
-	admissionReviewToResponse, err := buildAdmissionReviewToResponse(admissionReviewFromRequest, nodeAffinity)
+	admissionReviewToResponse, err := h.review(admissionReviewFromRequest)
 	if err != nil {
 		logrus.Errorf("build admission review response err: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -110,97 +104,267 @@ func (h *mutateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logrus.Debugf("request ended, requestMark: %v, endTime: %v, elapesdTime: %v", requestMark, endTime, elapesdTime)
 }
 
-func podNotToHandle(pod corev1.Pod) bool {
+func mutatePod(admissionReviewFromRequest admission.AdmissionReview) (admission.AdmissionReview, error) {
+	// the affinity of an existing pod can not change and a deleted pod has no object,
+	// other operations configured for the webhook are let through untouched
+	if admissionReviewFromRequest.Request.Operation != admission.Create {
+		logrus.Debugf("%s of pod %s let through", admissionReviewFromRequest.Request.Operation, admissionReviewFromRequest.Request.Name)
+		return buildAllowedAdmissionReview(admissionReviewFromRequest, nil), nil
+	}
+	raw := admissionReviewFromRequest.Request.Object.Raw
+	pod := corev1.Pod{}
+	if _, _, err := UniversalDeserializer.Decode(raw, nil, &pod); err != nil {
+		logrus.Errorf("decode object to pod err: %v", err)
+		return admission.AdmissionReview{}, err
+	}
+	namespace := admissionReviewFromRequest.Request.Namespace
+	// with reinvocation the webhook sees the pod again after later mutators, the decision was made and
+	// reserved the first time, and whatever they changed since is theirs to keep
+	if placed, reason := podAlreadyPlaced(pod); placed {
+		logrus.Debugf("pod %s already placed, %s", pod.GenerateName, reason)
+		return buildAllowedAdmissionReview(admissionReviewFromRequest, nil), nil
+	}
+	// dry run requests create no pod, they must not leave events or audit decisions behind
+	dryRun := admissionReviewFromRequest.Request.DryRun != nil && *admissionReviewFromRequest.Request.DryRun
+	target := eventTargetOf(pod, namespace)
+	if dryRun {
+		target = nil
+	}
+	if notToHandle, reason := podNotToHandle(pod); notToHandle {
+		logrus.Debugf("pod not to handle: %v, %s", pod.GenerateName, reason)
+		recordPodEvent(target, corev1.EventTypeNormal, reasonPlacementSkipped, "pod %s skipped: %s", pod.GenerateName, reason)
+		return buildAllowedAdmissionReview(admissionReviewFromRequest, nil), nil
+	}
+	policy, problems := resolvePlacementPolicy(namespace,
+		getReplicasetDeploymentAnnotations(pod.OwnerReferences[0].UID), pod.Annotations)
+	for _, problem := range problems {
+		logrus.WithField("pod", pod.GenerateName).Warnln(problem)
+		recordPodEvent(target, corev1.EventTypeWarning, reasonPlacementAnnotationBad, "%s", problem)
+	}
+	if policy.Mode == placementSkip {
+		logrus.Debugf("pod skipped by %s annotation: %v", policy.Source, pod.GenerateName)
+		recordPodEvent(target, corev1.EventTypeNormal, reasonPlacementSkipped, "pod %s skipped: opted out by %s annotation %s", pod.GenerateName, policy.Source, PlacementAnnotation)
+		return buildAllowedAdmissionReview(admissionReviewFromRequest, problems), nil
+	}
+	if podZoneOf(pod) != "" {
+		// a pod pinned to a zone by its own node selector cannot be spread
+		policy.ZoneSpread = false
+	}
+	kind, nodeAffinity := setNodeAffinity(pod.OwnerReferences[0].UID, policy)
+	// nodeAffinity := setNodeAffinity("aaa")
+	if kind == NodeSpot && policy.SpotDegraded {
+		kind, nodeAffinity = NodeOnDemand, nodeAffinityOf(NodeOnDemand, config.GetPlacement())
+		policy.Source = sourceFallback
+	}
+	warnings := problems
+	budgetExhausted := ""
+	budgetReserved := false
+	if kind == NodeOnDemand {
+		// audited pods get no on-demand affinity, they take nothing of the budget
+		if dryRun || policy.Audit {
+			budgetExhausted = onDemandBudgetProblem(namespace, pod)
+		} else {
+			budgetExhausted = reserveOnDemandBudget(pod.OwnerReferences[0].UID, namespace, pod)
+			budgetReserved = budgetExhausted == ""
+		}
+	}
+	if budgetExhausted != "" {
+		logrus.WithField("pod", pod.GenerateName).Warnln(budgetExhausted)
+		recordPodEvent(target, corev1.EventTypeWarning, reasonBudgetExhausted, "%s", budgetExhausted)
+		warnings = append(warnings, budgetExhausted)
+		kind, nodeAffinity = NodeSpot, nodeAffinityOf(NodeSpot, config.GetPlacement())
+		policy.Source = sourceBudget
+	}
+	available, unavailable := availableKindOf(kind, podZoneOf(pod))
+	if unavailable != "" {
+		logrus.WithField("pod", pod.GenerateName).Warnln(unavailable)
+		recordPodEvent(target, corev1.EventTypeWarning, reasonCapacityUnavailable, "%s", unavailable)
+		warnings = append(warnings, unavailable)
+	}
+	// a pod over the on-demand budget is not sent back to on-demand, it waits for spot capacity instead
+	if available != kind && !(budgetExhausted != "" && available == NodeOnDemand) {
+		kind, nodeAffinity = available, nodeAffinityOf(available, config.GetPlacement())
+		policy.Source = sourceCapacityFallback
+	}
+	if budgetReserved && kind != NodeOnDemand {
+		releaseOnDemandBudget(pod.OwnerReferences[0].UID)
+	}
+	if !hasInformersSynced() {
+		logrus.Warnf("placement of pod %s decided before the informers synced", pod.GenerateName)
+		recordPodEvent(target, corev1.EventTypeWarning, reasonPlacementBeforeSync,
+			"placement of pod %s was decided before the informer caches synced, the on-demand count may be off", pod.GenerateName)
+	}
+	if policy.Audit {
+		recordPodEvent(target, corev1.EventTypeNormal, placedReasonOf(kind), "pod %s would be assigned to %s nodes, placement from %s (audit, pod not patched)", pod.GenerateName, kind, policy.Source)
+		if !dryRun {
+			recordAuditDecision(pod.OwnerReferences[0].UID, namespace, admissionReviewFromRequest.Request.Name, kind)
+		}
+		// the decision is only kept in memory and in the audit log, audited pods are not changed at all
+		admissionReviewToResponse := buildAllowedAdmissionReview(admissionReviewFromRequest, warnings)
+		admissionReviewToResponse.Response.AuditAnnotations = map[string]string{
+			"placement":        string(kind),
+			"placement-source": string(policy.Source),
+		}
+		if unavailable != "" {
+			admissionReviewToResponse.Response.AuditAnnotations["placement-capacity"] = unavailable
+		}
+		if budgetExhausted != "" {
+			admissionReviewToResponse.Response.AuditAnnotations["placement-budget"] = budgetExhausted
+		}
+		return admissionReviewToResponse, nil
+	}
+	recordPodEvent(target, corev1.EventTypeNormal, placedReasonOf(kind), "pod %s assigned to %s nodes, placement from %s", pod.GenerateName, kind, policy.Source)
+	annotations := map[string]string{
+		PlacementSourceAnnotation: string(policy.Source),
+	}
+	labels := map[string]string{
+		CapacityLabel: string(kind),
+	}
+	extraOperations := []PatchOperation{}
+	if kind == NodeSpot {
+		extraOperations = append(extraOperations, spreadPatchOperations(pod, spotSpreadConstraintsOf(pod, config.GetPlacement()))...)
+	}
+	priorityOperations, priorityProblem := priorityPatchOperations(pod, kind)
+	if priorityProblem != "" {
+		logrus.WithField("pod", pod.GenerateName).Warnln(priorityProblem)
+		warnings = append(warnings, priorityProblem)
+	}
+	extraOperations = append(extraOperations, priorityOperations...)
+
+	admissionReviewToResponse, err := buildAdmissionReviewToResponse(admissionReviewFromRequest, pod, nodeAffinity, annotations, labels, extraOperations)
+	if err != nil {
+		return admissionReviewToResponse, err
+	}
+	admissionReviewToResponse.Response.Warnings = warnings
+	return admissionReviewToResponse, nil
+}
+
+// buildAllowedAdmissionReview allows the object without changing it
+func buildAllowedAdmissionReview(admissionReviewFromRequest admission.AdmissionReview, warnings []string) admission.AdmissionReview {
+	return admission.AdmissionReview{
+		TypeMeta: admissionReviewFromRequest.TypeMeta,
+		Response: &admission.AdmissionResponse{
+			UID:      admissionReviewFromRequest.Request.UID,
+			Allowed:  true,
+			Warnings: warnings,
+		},
+	}
+}
+
+// podAlreadyPlaced tells whether the pod carries the marks of an earlier call, audited pods carry none
+// and are decided again, their extra decision expires with auditDecisionTTL
+func podAlreadyPlaced(pod corev1.Pod) (bool, string) {
+	if source, ok := pod.Annotations[PlacementSourceAnnotation]; ok {
+		return true, fmt.Sprintf("annotation %s=%s", PlacementSourceAnnotation, source)
+	}
+	if capacity, ok := pod.Labels[CapacityLabel]; ok {
+		return true, fmt.Sprintf("label %s=%s", CapacityLabel, capacity)
+	}
+	return false, ""
+}
+
+// podNotToHandle also returns why the pod is not handled
+func podNotToHandle(pod corev1.Pod) (bool, string) {
 	if pod.OwnerReferences == nil {
-		return true
+		return true, "pod has no owner"
 	}
 	if len(pod.OwnerReferences) == 0 {
-		return true
+		return true, "pod has no owner"
 	}
 	ownerRef := pod.OwnerReferences[0]
 	if ownerRef.APIVersion != "apps/v1" || ownerRef.Kind != "ReplicaSet" {
-		return true
+		return true, fmt.Sprintf("owner %s %s is not a replicaset", ownerRef.Kind, ownerRef.Name)
 	}
-	if replicasetsOfNoneDeployments[ownerRef.UID] {
-		return true
+	if isReplicasetOfNoneDeployment(ownerRef.UID) {
+		return true, fmt.Sprintf("replicaset %s is not owned by a deployment", ownerRef.Name)
 	}
-	return false
+	return false, ""
 }
 
-func setNodeAffinity(ownerRefUID types.UID) corev1.NodeAffinity {
-	nodeAffinity := corev1.NodeAffinity{}
+func setNodeAffinity(ownerRefUID types.UID, policy placementPolicy) (NodeKind, corev1.NodeAffinity) {
+	placement := config.GetPlacement()
+	if policy.Mode == placementAllOnDemand {
+		return NodeOnDemand, nodeAffinityOf(NodeOnDemand, placement)
+	}
 
+	replicasetCacheLock.Lock()
+	defer replicasetCacheLock.Unlock()
 	podCachemap, ok := replicasetCache[ownerRefUID]
 	if !ok {
 		// we can know no pods of the replicaset has came out, of courese including one with on-demand node affinity
 		podCachemap = make(PodCachemap)
 		replicasetCache[ownerRefUID] = podCachemap
-
-		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
-			NodeSelectorTerms: []corev1.NodeSelectorTerm{
-				{
-					MatchExpressions: []corev1.NodeSelectorRequirement{
-						{
-							Key:      "node.kubernetes.io/capacity",
-							Operator: "In",
-							Values:   []string{"on-demand"},
-						},
-					},
-				},
-			},
-		}
-
-		return nodeAffinity
+	}
+	if policy.Mode == placementAllSpot {
+		return NodeSpot, withInstanceTypeGroup(nodeAffinityOf(NodeSpot, placement), podCachemap, placement)
 	}
 
-	otherPodHasOnDemandNodeAffinity := false
+	tiers := placement.EffectiveTiers()
+	tierPods := make(map[NodeKind]int)
+	onDemandPodsPerZone := make(map[string]int)
 	for _, pod := range podCachemap {
-		if podHasOnDemandNodeAffinity(pod) {
-			otherPodHasOnDemandNodeAffinity = true
-			break
+		// an evicted or terminating pod, or one on a node being interrupted, no longer keeps its tier
+		if !podIsLive(pod) || isNodeInterrupted(pod.Spec.NodeName) {
+			continue
+		}
+		kind := podTierOf(pod, tiers)
+		tierPods[kind]++
+		if kind == NodeOnDemand && policy.ZoneSpread {
+			onDemandPodsPerZone[podPlacedZoneOf(pod)]++
+		}
+	}
+	if policy.Audit {
+		// audited pods carry no affinity, their decisions are counted instead
+		for kind, pods := range auditedTierPods(ownerRefUID, podCachemap) {
+			tierPods[kind] += pods
 		}
 	}
 
-	// we just want only one pod with NodeAffinity to on-demand node
-
-	if otherPodHasOnDemandNodeAffinity {
-		// if replicasetCache[ownerRefUID] {
-		// the same replicaset already had one pod set NodeAffinity to on-demand node,
-		// we want the others pod of the replicaset to get NodeAffinity to spot node
-		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
-			NodeSelectorTerms: []corev1.NodeSelectorTerm{
-				{
-					MatchExpressions: []corev1.NodeSelectorRequirement{
-						{
-							Key:      "node.kubernetes.io/capacity",
-							Operator: "In",
-							Values:   []string{"spot"},
-						},
-					},
-				},
-			},
+	// the tiers are filled in order up to their quota, on-demand takes policy.OnDemandReplicas pods,
+	// the last tier takes the pods left
+	// the replicaset cache can lag behind a scale up or miss a new replicaset, percentage quotas then
+	// go by the pods seen so far and this one instead of rounding down to nothing
+	seen := 1
+	for _, pods := range tierPods {
+		seen += pods
+	}
+	replicas, ok := getReplicasetReplicas(ownerRefUID)
+	if !ok {
+		logrus.WithField("replicaset", ownerRefUID).Warnf("replicaset not cached, tier quotas go by the %d pods seen", seen)
+	}
+	if int(replicas) < seen {
+		replicas = int32(seen)
+	}
+	kind := NodeKind(tiers[len(tiers)-1].Name)
+	for _, tier := range tiers {
+		quota, limited := tierQuotaOf(tier, policy, int(replicas))
+		if !limited || tierPods[NodeKind(tier.Name)] < quota {
+			kind = NodeKind(tier.Name)
+			break
 		}
-	} else {
-		// no pod of the same replicaset has been set NodeAffinity to on-demand node, we set one here
-		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
-			NodeSelectorTerms: []corev1.NodeSelectorTerm{
-				{
-					MatchExpressions: []corev1.NodeSelectorRequirement{
-						{
-							Key:      "node.kubernetes.io/capacity",
-							Operator: "In",
-							Values:   []string{"on-demand"},
-						},
-					},
-				},
-			},
+	}
+	switch kind {
+	case NodeOnDemand:
+		if policy.ZoneSpread {
+			// without known zones the pod still goes to on-demand, only not to a given zone
+			if zone, ok := leastOnDemandZone(onDemandPodsPerZone, policy); ok {
+				return NodeOnDemand, withZone(nodeAffinityOf(NodeOnDemand, placement), zone)
+			}
 		}
+	case NodeSpot:
+		return NodeSpot, withInstanceTypeGroup(nodeAffinityOf(NodeSpot, placement), podCachemap, placement)
 	}
+	return kind, nodeAffinityOf(kind, placement)
+}
 
-	return nodeAffinity
+func nodeAffinityOf(kind NodeKind, placement config.PlacementConfig) corev1.NodeAffinity {
+	// every kind handed out is a tier of the placement
+	tier, _ := tierOf(placement, kind)
+	return tierNodeAffinityOf(tier)
 }
 
-func buildAdmissionReviewToResponse(admissionReviewFromRequest admission.AdmissionReview, nodeAffinity corev1.NodeAffinity) (admission.AdmissionReview, error) {
+func buildAdmissionReviewToResponse(admissionReviewFromRequest admission.AdmissionReview, pod corev1.Pod, nodeAffinity corev1.NodeAffinity,
+	annotations, labels map[string]string, extraOperations []PatchOperation) (admission.AdmissionReview, error) {
 	admissionReviewToResponse := admission.AdmissionReview{
 		TypeMeta: admissionReviewFromRequest.TypeMeta,
 		Response: &admission.AdmissionResponse{
@@ -218,6 +382,9 @@ func buildAdmissionReviewToResponse(admissionReviewFromRequest admission.Admissi
 		Value: affinity,
 	}
 	patchOperations = append(patchOperations, op)
+	patchOperations = append(patchOperations, annotationPatchOperations(pod, annotations)...)
+	patchOperations = append(patchOperations, mapPatchOperations("/metadata/labels", pod.Labels, labels)...)
+	patchOperations = append(patchOperations, extraOperations...)
 	patchBytes, err := json.Marshal(patchOperations)
 	if err != nil {
 		logrus.Errorf("json marshal err: %v", err)
@@ -232,6 +399,40 @@ func buildAdmissionReviewToResponse(admissionReviewFromRequest admission.Admissi
 	return admissionReviewToResponse, nil
 }
 
+// annotationPatchOperations adds the annotations to the pod, the annotations map itself is added when the pod has none
+func annotationPatchOperations(pod corev1.Pod, annotations map[string]string) []PatchOperation {
+	return mapPatchOperations("/metadata/annotations", pod.Annotations, annotations)
+}
+
+// mapPatchOperations adds the values to the map at path, the map itself is added when current is nil
+func mapPatchOperations(path string, current, values map[string]string) []PatchOperation {
+	if len(values) == 0 {
+		return nil
+	}
+	if current == nil {
+		return []PatchOperation{
+			{
+				Operation: "add",
+				Path:      path,
+				Value:     values,
+			},
+		}
+	}
+	patchOperations := []PatchOperation{}
+	for key, value := range values {
+		patchOperations = append(patchOperations, PatchOperation{
+			Operation: "add",
+			Path:      path + "/" + escapeJSONPointer(key),
+			Value:     value,
+		})
+	}
+	return patchOperations
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
 func extractAdmissionReviewFromRequest(requestBody []byte) (admission.AdmissionReview, error) {
 	var admissionReviewFromRequest admission.AdmissionReview
 	if _, _, err := UniversalDeserializer.Decode(requestBody, nil, &admissionReviewFromRequest); err != nil {
@@ -245,31 +446,21 @@ func extractAdmissionReviewFromRequest(requestBody []byte) (admission.AdmissionR
 	return admissionReviewFromRequest, nil
 }
 
-func podHasOnDemandNodeAffinity(pod corev1.Pod) bool {
-	if pod.Spec.Affinity == nil {
+// podIsLive tells if the pod runs or is going to, evicted, completed and terminating pods are not
+func podIsLive(pod corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
 		return false
 	}
-	if pod.Spec.Affinity.NodeAffinity == nil {
-		return false
-	}
-	if pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
-		return false
-	}
-	if pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms == nil {
-		return false
-	}
-	for _, term := range pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
-		for _, expression := range term.MatchExpressions {
-			if expression.Key == nodeSelectorRequirementKey {
-				if expression.Operator == corev1.NodeSelectorOpIn {
-					for _, value := range expression.Values {
-						if value == string(NodeOnDemand) {
-							return true
-						}
-					}
-				}
-			}
-		}
-	}
-	return false
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// podHasSpotNodeAffinity tells if the webhook sent the pod to spot nodes
+func podHasSpotNodeAffinity(pod corev1.Pod, placement config.PlacementConfig) bool {
+	tier, ok := tierOf(placement, NodeSpot)
+	return ok && podHasTierNodeAffinity(pod, tier)
+}
+
+func podHasOnDemandNodeAffinity(pod corev1.Pod, placement config.PlacementConfig) bool {
+	tier, ok := tierOf(placement, NodeOnDemand)
+	return ok && podHasTierNodeAffinity(pod, tier)
 }
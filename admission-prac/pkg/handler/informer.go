@@ -2,6 +2,9 @@ package handler
 
 import (
 	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -13,17 +16,41 @@ import (
 )
 
 var (
+	// replicasetCacheLock guards replicasetCache, it is read by admission requests and the rebalancer
+	replicasetCacheLock          sync.RWMutex
 	replicasetCache              = make(map[types.UID]PodCachemap)
 	replicasetsOfNoneDeployments = make(map[types.UID]bool)
+	// informersSynced is set once all caches synced, decisions made before may miss pods of the replicaset
+	informersSynced          int32
+	namespaceAnnotationsLock sync.RWMutex
+	namespaceAnnotations     = make(map[string]map[string]string)
+	// workloadLock guards replicasetsOfNoneDeployments and the maps below, admission requests read them
+	workloadLock          sync.RWMutex
+	replicasetDeployments = make(map[types.UID]deploymentOfReplicaset)
+	// replicasetReplicas is the desired replicas of the replicasets of deployments
+	replicasetReplicas    = make(map[types.UID]int32)
+	deploymentAnnotations = make(map[string]map[string]string)
 )
 
 type PodCachemap map[types.UID]corev1.Pod
 
+type deploymentOfReplicaset struct {
+	Namespace string
+	Name      string
+	UID       types.UID
+}
+
+func (d deploymentOfReplicaset) key() string {
+	return d.Namespace + "/" + d.Name
+}
+
 type replicasetEventHandler struct {
 }
 
 func (h *replicasetEventHandler) OnAdd(obj interface{}) {
 	replicaset := obj.(*appsv1.ReplicaSet)
+	workloadLock.Lock()
+	defer workloadLock.Unlock()
 	ownerReferences := replicaset.GetOwnerReferences()
 	if ownerReferences == nil {
 		replicasetsOfNoneDeployments[replicaset.UID] = true
@@ -38,6 +65,16 @@ func (h *replicasetEventHandler) OnAdd(obj interface{}) {
 		replicasetsOfNoneDeployments[replicaset.UID] = true
 		return
 	}
+	replicasetDeployments[replicaset.UID] = deploymentOfReplicaset{
+		Namespace: replicaset.Namespace,
+		Name:      ownerRef.Name,
+		UID:       ownerRef.UID,
+	}
+	replicas := int32(1)
+	if replicaset.Spec.Replicas != nil {
+		replicas = *replicaset.Spec.Replicas
+	}
+	replicasetReplicas[replicaset.UID] = replicas
 }
 
 func (h *replicasetEventHandler) OnUpdate(oldObj, newObj interface{}) {
@@ -45,8 +82,130 @@ func (h *replicasetEventHandler) OnUpdate(oldObj, newObj interface{}) {
 }
 
 func (h *replicasetEventHandler) OnDelete(obj interface{}) {
-	replicaset := obj.(*appsv1.ReplicaSet)
+	replicaset, ok := obj.(*appsv1.ReplicaSet)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if replicaset, ok = tombstone.Obj.(*appsv1.ReplicaSet); !ok {
+			return
+		}
+	}
+	forgetAuditedReplicaset(replicaset.UID)
+	replicasetCacheLock.Lock()
+	delete(replicasetCache, replicaset.UID)
+	replicasetCacheLock.Unlock()
+	workloadLock.Lock()
+	defer workloadLock.Unlock()
 	delete(replicasetsOfNoneDeployments, replicaset.UID)
+	delete(replicasetDeployments, replicaset.UID)
+	delete(replicasetReplicas, replicaset.UID)
+}
+
+type deploymentEventHandler struct {
+}
+
+func (h *deploymentEventHandler) OnAdd(obj interface{}) {
+	deployment := obj.(*appsv1.Deployment)
+	workloadLock.Lock()
+	defer workloadLock.Unlock()
+	deploymentAnnotations[deployment.Namespace+"/"+deployment.Name] = deployment.Annotations
+	enqueueOnDemandPDB(deployment.Namespace + "/" + deployment.Name)
+}
+
+func (h *deploymentEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.OnAdd(newObj)
+}
+
+func (h *deploymentEventHandler) OnDelete(obj interface{}) {
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if deployment, ok = tombstone.Obj.(*appsv1.Deployment); !ok {
+			return
+		}
+	}
+	workloadLock.Lock()
+	defer workloadLock.Unlock()
+	delete(deploymentAnnotations, deployment.Namespace+"/"+deployment.Name)
+}
+
+// getReplicasetDeploymentAnnotations returns the annotations of the deployment owning the replicaset,
+// nil when the replicaset or deployment is not in the cache yet
+// isReplicasetOfNoneDeployment tells whether the replicaset is known to have no deployment as its owner
+func isReplicasetOfNoneDeployment(replicasetUID types.UID) bool {
+	workloadLock.RLock()
+	defer workloadLock.RUnlock()
+	return replicasetsOfNoneDeployments[replicasetUID]
+}
+
+func getReplicasetDeploymentAnnotations(replicasetUID types.UID) map[string]string {
+	workloadLock.RLock()
+	defer workloadLock.RUnlock()
+	deployment, ok := replicasetDeployments[replicasetUID]
+	if !ok {
+		return nil
+	}
+	return deploymentAnnotations[deployment.key()]
+}
+
+// podsOfReplicaset returns a copy of the cached pods of the replicaset
+func podsOfReplicaset(replicasetUID types.UID) []corev1.Pod {
+	replicasetCacheLock.RLock()
+	defer replicasetCacheLock.RUnlock()
+	pods := []corev1.Pod{}
+	for _, pod := range replicasetCache[replicasetUID] {
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+// replicasetsOnNode returns the replicasets with a live pod on the node
+func replicasetsOnNode(nodeName string) []types.UID {
+	replicasetCacheLock.RLock()
+	defer replicasetCacheLock.RUnlock()
+	replicasets := []types.UID{}
+	for replicasetUID, podCachemap := range replicasetCache {
+		for _, pod := range podCachemap {
+			if pod.Spec.NodeName == nodeName && podIsLive(pod) {
+				replicasets = append(replicasets, replicasetUID)
+				break
+			}
+		}
+	}
+	return replicasets
+}
+
+func cachedReplicasets() []types.UID {
+	replicasetCacheLock.RLock()
+	defer replicasetCacheLock.RUnlock()
+	replicasets := []types.UID{}
+	for uid := range replicasetCache {
+		replicasets = append(replicasets, uid)
+	}
+	return replicasets
+}
+
+func getReplicasetReplicas(replicasetUID types.UID) (int32, bool) {
+	workloadLock.RLock()
+	defer workloadLock.RUnlock()
+	replicas, ok := replicasetReplicas[replicasetUID]
+	return replicas, ok
+}
+
+func hasInformersSynced() bool {
+	return atomic.LoadInt32(&informersSynced) == 1
+}
+
+func getReplicasetDeployment(replicasetUID types.UID) (deploymentOfReplicaset, bool) {
+	workloadLock.RLock()
+	defer workloadLock.RUnlock()
+	deployment, ok := replicasetDeployments[replicasetUID]
+	return deployment, ok
 }
 
 type podEventHandler struct {
@@ -65,12 +224,22 @@ func (h *podEventHandler) OnAdd(obj interface{}) {
 	if ownerRef.APIVersion != "apps/v1" || ownerRef.Kind != "ReplicaSet" {
 		return
 	}
+	replicasetCacheLock.Lock()
 	podCacheMap, ok := replicasetCache[ownerRef.UID]
 	if !ok {
 		podCacheMap = make(PodCachemap)
 	}
 	podCacheMap[pod.UID] = *pod
 	replicasetCache[ownerRef.UID] = podCacheMap
+	replicasetCacheLock.Unlock()
+	// the pod is counted from now on, its reservation is no longer needed
+	if podHasOnDemandNodeAffinity(*pod, config.GetPlacement()) {
+		releaseOnDemandBudget(ownerRef.UID)
+	}
+	observeAuditedPod(ownerRef.UID, pod)
+	enqueueRebalance(ownerRef.UID)
+	enqueueFallback(ownerRef.UID)
+	enqueueOnDemandPDBOf(ownerRef.UID)
 }
 
 func (h *podEventHandler) OnUpdate(oldObj, newObj interface{}) {
@@ -86,16 +255,31 @@ func (h *podEventHandler) OnUpdate(oldObj, newObj interface{}) {
 	if ownerRef.APIVersion != "apps/v1" || ownerRef.Kind != "ReplicaSet" {
 		return
 	}
+	replicasetCacheLock.Lock()
 	podCacheMap, ok := replicasetCache[ownerRef.UID]
 	if !ok {
 		podCacheMap = make(PodCachemap)
 	}
 	podCacheMap[pod.UID] = *pod
 	replicasetCache[ownerRef.UID] = podCacheMap
+	replicasetCacheLock.Unlock()
+	observeAuditedPod(ownerRef.UID, pod)
+	enqueueRebalance(ownerRef.UID)
+	enqueueFallback(ownerRef.UID)
+	enqueueOnDemandPDBOf(ownerRef.UID)
 }
 
 func (h *podEventHandler) OnDelete(obj interface{}) {
-	pod := obj.(*corev1.Pod)
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if pod, ok = tombstone.Obj.(*corev1.Pod); !ok {
+			return
+		}
+	}
 	ownerReferences := pod.GetOwnerReferences()
 	if ownerReferences == nil {
 		return
@@ -107,19 +291,64 @@ func (h *podEventHandler) OnDelete(obj interface{}) {
 	if ownerRef.APIVersion != "apps/v1" || ownerRef.Kind != "ReplicaSet" {
 		return
 	}
+	replicasetCacheLock.Lock()
 	podCacheMap, ok := replicasetCache[ownerRef.UID]
 	if !ok {
-		podCacheMap = make(PodCachemap)
+		replicasetCacheLock.Unlock()
 		return
 	}
 	delete(podCacheMap, pod.UID)
 	replicasetCache[ownerRef.UID] = podCacheMap
+	replicasetCacheLock.Unlock()
+	forgetAuditedPod(pod.UID)
+	enqueueRebalance(ownerRef.UID)
+	enqueueFallback(ownerRef.UID)
+	enqueueOnDemandPDBOf(ownerRef.UID)
 }
 
-func StartInformer(stopCh <-chan struct{}) {
+type namespaceEventHandler struct {
+}
+
+func (h *namespaceEventHandler) OnAdd(obj interface{}) {
+	namespace := obj.(*corev1.Namespace)
+	namespaceAnnotationsLock.Lock()
+	defer namespaceAnnotationsLock.Unlock()
+	namespaceAnnotations[namespace.Name] = namespace.Annotations
+}
+
+func (h *namespaceEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.OnAdd(newObj)
+}
+
+func (h *namespaceEventHandler) OnDelete(obj interface{}) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if namespace, ok = tombstone.Obj.(*corev1.Namespace); !ok {
+			return
+		}
+	}
+	namespaceAnnotationsLock.Lock()
+	defer namespaceAnnotationsLock.Unlock()
+	delete(namespaceAnnotations, namespace.Name)
+}
+
+func getNamespaceAnnotations(namespace string) map[string]string {
+	namespaceAnnotationsLock.RLock()
+	defer namespaceAnnotationsLock.RUnlock()
+	return namespaceAnnotations[namespace]
+}
+
+// NewInformerFactory is shared by the webhook and the controllers next to it, so each resource is watched once
+func NewInformerFactory() informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactory(clientset.GetClientset(), time.Duration(time.Second))
+}
+
+func StartInformer(informerFactory informers.SharedInformerFactory, stopCh <-chan struct{}) {
 	logrus.Debug("staring informer")
-	cs := clientset.GetClientset()
-	informerFactory := informers.NewSharedInformerFactory(cs, time.Duration(time.Second))
 
 	podInformer := informerFactory.Core().V1().Pods().Informer()
 	ph := &podEventHandler{}
@@ -127,14 +356,34 @@ func StartInformer(stopCh <-chan struct{}) {
 	rsInformer := informerFactory.Apps().V1().ReplicaSets().Informer()
 	rsh := &replicasetEventHandler{}
 	rsInformer.AddEventHandler(rsh)
+	nsInformer := informerFactory.Core().V1().Namespaces().Informer()
+	nsh := &namespaceEventHandler{}
+	nsInformer.AddEventHandler(nsh)
+	deployInformer := informerFactory.Apps().V1().Deployments().Informer()
+	deploymentLister = informerFactory.Apps().V1().Deployments().Lister()
+	deployh := &deploymentEventHandler{}
+	deployInformer.AddEventHandler(deployh)
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	nodeLister = nodeInformer.Lister()
+	nodeInformer.Informer().AddEventHandler(&nodeEventHandler{})
+	pdbInformer := informerFactory.Policy().V1().PodDisruptionBudgets()
+	pdbLister = pdbInformer.Lister()
+	synced := []cache.InformerSynced{podInformer.HasSynced, rsInformer.HasSynced, nsInformer.HasSynced, deployInformer.HasSynced,
+		nodeInformer.Informer().HasSynced, pdbInformer.Informer().HasSynced}
+	if config.GetConfig().Priority.Enabled {
+		priorityClassInformer := informerFactory.Scheduling().V1().PriorityClasses()
+		priorityClassLister = priorityClassInformer.Lister()
+		synced = append(synced, priorityClassInformer.Informer().HasSynced)
+	}
 
 	logrus.Debug("to start informer")
 	informerFactory.Start(stopCh)
 
 	logrus.Debug("to sync cache")
-	if !cache.WaitForCacheSync(stopCh, podInformer.HasSynced, rsInformer.HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		logrus.Error("failed to sync cache")
 		return
 	}
+	atomic.StoreInt32(&informersSynced, 1)
 	logrus.Debug("cache synced")
 }
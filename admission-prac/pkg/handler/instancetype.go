@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"strings"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// instanceTypeGroupOf returns the index of the instance type group the pod prefers, -1 if none
+func instanceTypeGroupOf(pod corev1.Pod, groups [][]string) int {
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil {
+		return -1
+	}
+	for _, term := range pod.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		for _, expression := range term.Preference.MatchExpressions {
+			if expression.Key != corev1.LabelInstanceTypeStable || expression.Operator != corev1.NodeSelectorOpIn {
+				continue
+			}
+			values := strings.Join(expression.Values, ",")
+			for i, group := range groups {
+				if strings.Join(group, ",") == values {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// withInstanceTypeGroup makes the spot pod prefer the instance type group the fewest live spot pods
+// of its replicaset prefer, so a reclaim of one family does not hit all of them. The cache must be locked
+func withInstanceTypeGroup(nodeAffinity corev1.NodeAffinity, podCachemap PodCachemap, placement config.PlacementConfig) corev1.NodeAffinity {
+	groups := placement.SpotInstanceTypeGroups
+	if len(groups) == 0 {
+		return nodeAffinity
+	}
+	podsPerGroup := make([]int, len(groups))
+	for _, pod := range podCachemap {
+		if !podIsLive(pod) || !podHasSpotNodeAffinity(pod, placement) {
+			continue
+		}
+		if i := instanceTypeGroupOf(pod, groups); i >= 0 {
+			podsPerGroup[i]++
+		}
+	}
+	chosen := 0
+	for i, count := range podsPerGroup {
+		if count < podsPerGroup[chosen] {
+			chosen = i
+		}
+	}
+	nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		corev1.PreferredSchedulingTerm{
+			Weight: placement.SpotInstanceTypeWeight,
+			Preference: corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{
+					{
+						Key:      corev1.LabelInstanceTypeStable,
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   groups[chosen],
+					},
+				},
+			},
+		})
+	return nodeAffinity
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+
+	"practices/admission-prac/pkg/config"
+	"practices/admission-prac/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// nodePoolUnknown is reported for nodes without any of the node pool labels
+	nodePoolUnknown = "unknown"
+)
+
+var (
+	interruptionLock sync.RWMutex
+	// interruptedNodes maps a node being interrupted to the signal it carries
+	interruptedNodes = make(map[string]string)
+)
+
+// interruptionSignalOf returns the configured taint or condition telling that the node is about to go
+func interruptionSignalOf(node *corev1.Node, interruption config.InterruptionConfig) (string, bool) {
+	for _, taint := range node.Spec.Taints {
+		for _, key := range interruption.Taints {
+			if taint.Key == key {
+				return fmt.Sprintf("taint %s", taint.Key), true
+			}
+		}
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		for _, conditionType := range interruption.Conditions {
+			if string(condition.Type) == conditionType {
+				return fmt.Sprintf("condition %s", condition.Type), true
+			}
+		}
+	}
+	return "", false
+}
+
+func nodePoolOf(node *corev1.Node, interruption config.InterruptionConfig) string {
+	for _, label := range interruption.NodePoolLabels {
+		if pool, ok := node.Labels[label]; ok {
+			return pool
+		}
+	}
+	return nodePoolUnknown
+}
+
+func isNodeInterrupted(nodeName string) bool {
+	if nodeName == "" {
+		return false
+	}
+	interruptionLock.RLock()
+	defer interruptionLock.RUnlock()
+	_, ok := interruptedNodes[nodeName]
+	return ok
+}
+
+type nodeEventHandler struct {
+}
+
+func (h *nodeEventHandler) OnAdd(obj interface{}) {
+	node := obj.(*corev1.Node)
+	interruption := config.GetConfig().Interruption
+	signal, interrupted := interruptionSignalOf(node, interruption)
+
+	interruptionLock.Lock()
+	_, wasInterrupted := interruptedNodes[node.Name]
+	if interrupted {
+		interruptedNodes[node.Name] = signal
+	} else {
+		delete(interruptedNodes, node.Name)
+	}
+	interruptionLock.Unlock()
+	observeNodeAvailability(node, interrupted)
+	if !interrupted || wasInterrupted {
+		return
+	}
+
+	pool := nodePoolOf(node, interruption)
+	metrics.NodeInterruptions.WithLabelValues(pool, nodeCapacityOf(node.Name)).Inc()
+	logrus.WithFields(logrus.Fields{
+		"node":   node.Name,
+		"pool":   pool,
+		"signal": signal,
+	}).Println("node is being interrupted")
+	// the rebalancer replaces on-demand pods of the node before it disappears
+	// and its poddisruptionbudget stops counting them so the eviction is allowed
+	for _, replicasetUID := range replicasetsOnNode(node.Name) {
+		enqueueOnDemandPDBOf(replicasetUID)
+		enqueueRebalance(replicasetUID)
+	}
+}
+
+func (h *nodeEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.OnAdd(newObj)
+}
+
+func (h *nodeEventHandler) OnDelete(obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if node, ok = tombstone.Obj.(*corev1.Node); !ok {
+			return
+		}
+	}
+	forgetNodeAvailability(node.Name)
+	interruptionLock.Lock()
+	defer interruptionLock.Unlock()
+	delete(interruptedNodes, node.Name)
+}
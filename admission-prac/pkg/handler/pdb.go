@@ -0,0 +1,279 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	listersappsv1 "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type OnDemandPDBParameters struct {
+	// Interval is how often all deployments are checked, deployment changes trigger a check right away
+	Interval time.Duration
+	// NameSuffix is appended to the deployment name to name its poddisruptionbudget
+	NameSuffix string
+}
+
+var (
+	onDemandPDBQueue = workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Second, 10*time.Minute), "ondemandpdb")
+	onDemandPDBRunning int32
+	deploymentLister   listersappsv1.DeploymentLister
+	forcePDBApply      = true
+)
+
+type onDemandPDB struct {
+	parameters OnDemandPDBParameters
+}
+
+// enqueueOnDemandPDB asks the controller to check the deployment, it does nothing while the controller is off
+func enqueueOnDemandPDB(deploymentKey string) {
+	if atomic.LoadInt32(&onDemandPDBRunning) == 1 {
+		onDemandPDBQueue.Add(deploymentKey)
+	}
+}
+
+// enqueueOnDemandPDBOf asks the controller to check the deployment owning the replicaset
+func enqueueOnDemandPDBOf(replicasetUID types.UID) {
+	if atomic.LoadInt32(&onDemandPDBRunning) == 0 {
+		return
+	}
+	if deployment, ok := getReplicasetDeployment(replicasetUID); ok {
+		onDemandPDBQueue.Add(deployment.key())
+	}
+}
+
+// StartOnDemandPDB keeps a poddisruptionbudget per handled deployment selecting its on-demand pods,
+// so a drain can not take them all together with the spot pods. It runs until stopCh is closed
+func StartOnDemandPDB(parameters OnDemandPDBParameters, stopCh <-chan struct{}) {
+	logrus.Println("starting on-demand poddisruptionbudget controller")
+	p := &onDemandPDB{parameters: parameters}
+	defer onDemandPDBQueue.ShutDown()
+
+	// before the sync no deployment looks handled, their budgets would be deleted
+	if err := wait.PollImmediateUntil(time.Second, func() (bool, error) { return hasInformersSynced(), nil }, stopCh); err != nil {
+		logrus.Debug("on-demand poddisruptionbudget controller stopped before informers synced")
+		return
+	}
+	atomic.StoreInt32(&onDemandPDBRunning, 1)
+
+	go wait.Until(func() {
+		deployments, err := deploymentLister.List(labels.Everything())
+		if err != nil {
+			logrus.WithError(err).Warn("list deployments from cache err")
+			return
+		}
+		for _, deployment := range deployments {
+			onDemandPDBQueue.Add(deployment.Namespace + "/" + deployment.Name)
+		}
+	}, parameters.Interval, stopCh)
+	go wait.Until(p.runWorker, time.Second, stopCh)
+	<-stopCh
+	logrus.Debug("on-demand poddisruptionbudget controller stopped")
+}
+
+func (p *onDemandPDB) runWorker() {
+	for p.processNextItem() {
+	}
+}
+
+func (p *onDemandPDB) processNextItem() bool {
+	key, quit := onDemandPDBQueue.Get()
+	if quit {
+		return false
+	}
+	defer onDemandPDBQueue.Done(key)
+
+	if err := p.reconcile(key.(string)); err != nil {
+		logrus.WithField("deployment", key).WithError(err).Warn("reconcile on-demand poddisruptionbudget err, backing off")
+		onDemandPDBQueue.AddRateLimited(key)
+		return true
+	}
+	onDemandPDBQueue.Forget(key)
+	return true
+}
+
+// reconcile applies the budget of a handled deployment with minAvailable at its on-demand count,
+// and deletes it once the deployment sends no pod to on-demand. A deleted deployment takes its budget
+// with it through the owner reference
+func (p *onDemandPDB) reconcile(deploymentKey string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(deploymentKey)
+	if err != nil {
+		return nil
+	}
+	deployment, err := deploymentLister.Deployments(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pdbName := deployment.Name + p.parameters.NameSuffix
+
+	// the budget protects the on-demand pods that run, up to the on-demand count of the policy.
+	// Pods sent to spot by the budget or the capacity fallback are not waited for, extra on-demand pods
+	// of a spot fallback may be disrupted, and pods on a node being interrupted are left to the rebalancer
+	onDemand := 0
+	if placed, running := onDemandPodsOfDeployment(deployment.UID); placed {
+		policy, _ := resolvePlacementPolicy(namespace, deployment.Annotations, deployment.Spec.Template.Annotations)
+		switch policy.Mode {
+		case placementAllOnDemand:
+			onDemand = replicasOf(deployment)
+		case placementCounted:
+			onDemand = policy.onDemandWanted()
+		}
+		if onDemand > running {
+			onDemand = running
+		}
+	}
+
+	existing, err := pdbLister.PodDisruptionBudgets(namespace).Get(pdbName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && !isOwnedBy(existing.OwnerReferences, deployment.UID) {
+		logrus.WithField("pdb", namespace+"/"+pdbName).Debug("poddisruptionbudget not owned by the deployment, left alone")
+		return nil
+	}
+	if onDemand == 0 {
+		return p.deleteOwned(deployment, pdbName)
+	}
+	pdb := buildOnDemandPDB(deployment, pdbName, onDemand)
+	if err == nil && reflect.DeepEqual(existing.Spec.MinAvailable, pdb.Spec.MinAvailable) && reflect.DeepEqual(existing.Spec.Selector, pdb.Spec.Selector) {
+		return nil
+	}
+	data, err := json.Marshal(pdb)
+	if err != nil {
+		return err
+	}
+	_, err = clientset.GetClientset().PolicyV1().PodDisruptionBudgets(namespace).Patch(context.TODO(), pdbName, types.ApplyPatchType, data, v1.PatchOptions{
+		FieldManager: "admission-prac",
+		Force:        &forcePDBApply,
+	})
+	if err != nil {
+		return fmt.Errorf("apply poddisruptionbudget %s/%s: %v", namespace, pdbName, err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"deployment":   deploymentKey,
+		"pdb":          pdbName,
+		"minAvailable": onDemand,
+	}).Println("applied on-demand poddisruptionbudget")
+	return nil
+}
+
+// deleteOwned deletes the budget when it exists, the caller checked the deployment owns it
+func (p *onDemandPDB) deleteOwned(deployment *appsv1.Deployment, pdbName string) error {
+	existing, err := pdbLister.PodDisruptionBudgets(deployment.Namespace).Get(pdbName)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = clientset.GetClientset().PolicyV1().PodDisruptionBudgets(deployment.Namespace).Delete(context.TODO(), pdbName, v1.DeleteOptions{
+		Preconditions: &v1.Preconditions{UID: &existing.UID},
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		return fmt.Errorf("delete poddisruptionbudget %s/%s: %v", deployment.Namespace, pdbName, err)
+	}
+	logrus.WithField("pdb", deployment.Namespace+"/"+pdbName).Println("deleted on-demand poddisruptionbudget")
+	return nil
+}
+
+func buildOnDemandPDB(deployment *appsv1.Deployment, pdbName string, onDemand int) *policyv1.PodDisruptionBudget {
+	selector := &v1.LabelSelector{}
+	if deployment.Spec.Selector != nil {
+		selector = deployment.Spec.Selector.DeepCopy()
+	}
+	if selector.MatchLabels == nil {
+		selector.MatchLabels = make(map[string]string)
+	}
+	selector.MatchLabels[CapacityLabel] = string(NodeOnDemand)
+	minAvailable := intstr.FromInt(onDemand)
+	controller := true
+	return &policyv1.PodDisruptionBudget{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "policy/v1",
+			Kind:       "PodDisruptionBudget",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      pdbName,
+			Namespace: deployment.Namespace,
+			// no blockOwnerDeletion, it would need the finalizers of deployments
+			OwnerReferences: []v1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       deployment.Name,
+					UID:        deployment.UID,
+					Controller: &controller,
+				},
+			},
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     selector,
+		},
+	}
+}
+
+// onDemandPodsOfDeployment tells if the webhook labelled a pod of the deployment, deployments it does not handle
+// get no budget, and counts its live pods labelled on-demand that are not on a node being interrupted
+func onDemandPodsOfDeployment(deploymentUID types.UID) (bool, int) {
+	workloadLock.RLock()
+	replicasets := []types.UID{}
+	for replicasetUID, deployment := range replicasetDeployments {
+		if deployment.UID == deploymentUID {
+			replicasets = append(replicasets, replicasetUID)
+		}
+	}
+	workloadLock.RUnlock()
+	placed := false
+	onDemand := 0
+	for _, replicasetUID := range replicasets {
+		for _, pod := range podsOfReplicaset(replicasetUID) {
+			capacity, ok := pod.Labels[CapacityLabel]
+			if !ok {
+				continue
+			}
+			placed = true
+			if capacity == string(NodeOnDemand) && podIsLive(pod) && !isNodeInterrupted(pod.Spec.NodeName) {
+				onDemand++
+			}
+		}
+	}
+	return placed, onDemand
+}
+
+func isOwnedBy(ownerReferences []v1.OwnerReference, uid types.UID) bool {
+	for _, ownerReference := range ownerReferences {
+		if ownerReference.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func replicasOf(deployment *appsv1.Deployment) int {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return int(*deployment.Spec.Replicas)
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"practices/admission-prac/pkg/config"
+)
+
+const (
+	annotationPrefix = "admission-prac/"
+	// PlacementAnnotation is all-on-demand or all-spot, on a namespace it changes the default of all its workloads.
+	// On a deployment or its pod template it can also be skip, leaving the pods alone
+	PlacementAnnotation = annotationPrefix + "placement"
+	// OnDemandReplicasAnnotation is how many pods of a replicaset go to on-demand nodes
+	OnDemandReplicasAnnotation = annotationPrefix + "on-demand-replicas"
+	// PlacementSourceAnnotation is set on every handled pod, it tells which layer supplied the placement
+	PlacementSourceAnnotation = annotationPrefix + "placement-source"
+	// SpotDegradedAnnotation is set on a deployment by the fallback controller while spot capacity is exhausted,
+	// its pods then go to on-demand nodes. The value is the time it was set
+	SpotDegradedAnnotation = annotationPrefix + "spot-degraded"
+	// OnDemandPerZoneAnnotation is how many pods of a replicaset go to on-demand nodes in each zone
+	OnDemandPerZoneAnnotation = annotationPrefix + "on-demand-per-zone"
+	// OnDemandSpreadAnnotation set to zone spreads the on-demand pods of a replicaset over the zones
+	OnDemandSpreadAnnotation = annotationPrefix + "on-demand-spread"
+	// AuditAnnotation set to true on a namespace records the decisions for its pods without patching them
+	AuditAnnotation = annotationPrefix + "audit"
+)
+
+type placementMode string
+
+const (
+	// placementCounted sends OnDemandReplicas pods of a replicaset to on-demand and the rest to spot
+	placementCounted     placementMode = ""
+	placementAllOnDemand placementMode = "all-on-demand"
+	placementAllSpot     placementMode = "all-spot"
+	// placementSkip leaves the pods untouched, only workloads can opt out
+	placementSkip placementMode = "skip"
+)
+
+const (
+	spreadZone = "zone"
+	spreadNone = "none"
+)
+
+type placementSource string
+
+const (
+	sourceCluster    placementSource = "cluster"
+	sourceNamespace  placementSource = "namespace"
+	sourceDeployment placementSource = "deployment"
+	// sourcePodTemplate is the annotations of the pod itself, they come from the pod template of the deployment
+	sourcePodTemplate placementSource = "pod-template"
+	// sourceFallback pods were meant for spot but sent to on-demand while their deployment is degraded
+	sourceFallback placementSource = "spot-fallback"
+	// sourceCapacityFallback pods were sent to the other capacity as their own had no available node
+	sourceCapacityFallback placementSource = "capacity-fallback"
+	// sourceBudget pods would have gone to on-demand but the on-demand budget was exhausted
+	sourceBudget placementSource = "on-demand-budget"
+)
+
+type placementPolicy struct {
+	Mode             placementMode
+	OnDemandReplicas int
+	// OnDemandPerZone replaces OnDemandReplicas when set, that many on-demand pods go to each zone
+	OnDemandPerZone int
+	// ZoneSpread puts each next on-demand pod in the zone with the fewest
+	ZoneSpread   bool
+	Source       placementSource
+	Audit        bool
+	SpotDegraded bool
+}
+
+func clusterPlacementPolicy(placement config.PlacementConfig) placementPolicy {
+	return placementPolicy{
+		Mode:             placementCounted,
+		OnDemandReplicas: placement.OnDemandReplicas,
+		Source:           sourceCluster,
+		Audit:            placement.Audit,
+	}
+}
+
+// withAnnotations layers the placement annotations over the policy, invalid values are skipped and reported
+func (p placementPolicy) withAnnotations(annotations map[string]string, source placementSource) (placementPolicy, []string) {
+	problems := []string{}
+	if value, ok := annotations[OnDemandReplicasAnnotation]; ok {
+		replicas, err := strconv.Atoi(value)
+		if err != nil || replicas < 0 {
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q is not a non-negative number, ignored", source, OnDemandReplicasAnnotation, value))
+		} else {
+			p.Mode = placementCounted
+			p.OnDemandReplicas = replicas
+			p.OnDemandPerZone = 0
+			p.Source = source
+		}
+	}
+	if value, ok := annotations[OnDemandPerZoneAnnotation]; ok {
+		replicas, err := strconv.Atoi(value)
+		if err != nil || replicas < 0 {
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q is not a non-negative number, ignored", source, OnDemandPerZoneAnnotation, value))
+		} else {
+			p.Mode = placementCounted
+			p.OnDemandPerZone = replicas
+			p.ZoneSpread = replicas > 0
+			p.Source = source
+		}
+	}
+	if value, ok := annotations[OnDemandSpreadAnnotation]; ok {
+		switch value {
+		case spreadZone, spreadNone:
+			p.ZoneSpread = value == spreadZone
+		default:
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q must be %s or %s, ignored", source, OnDemandSpreadAnnotation, value, spreadZone, spreadNone))
+		}
+	}
+	if value, ok := annotations[PlacementAnnotation]; ok {
+		switch mode := placementMode(value); mode {
+		case placementAllOnDemand, placementAllSpot:
+			p.Mode = mode
+			p.Source = source
+		case placementSkip:
+			if source == sourceDeployment || source == sourcePodTemplate {
+				p.Mode = mode
+				p.Source = source
+				break
+			}
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q is only allowed on workloads, ignored", source, PlacementAnnotation, value))
+		default:
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q must be %s, %s or %s, ignored", source, PlacementAnnotation, value, placementAllOnDemand, placementAllSpot, placementSkip))
+		}
+	}
+	if _, ok := annotations[SpotDegradedAnnotation]; ok && source == sourceDeployment {
+		p.SpotDegraded = true
+	}
+	if value, ok := annotations[AuditAnnotation]; ok {
+		audit, err := strconv.ParseBool(value)
+		if source != sourceNamespace {
+			// a workload must not hide itself from the placement
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q is only allowed on namespaces, ignored", source, AuditAnnotation, value))
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("%s annotation %s=%q must be true or false, ignored", source, AuditAnnotation, value))
+		} else {
+			p.Audit = audit
+		}
+	}
+	return p, problems
+}
+
+// resolvePlacementPolicy layers the cluster config, the namespace annotations, the deployment annotations
+// and the pod template annotations, each layer overrides the one before
+func resolvePlacementPolicy(namespace string, deploymentAnnotations, podAnnotations map[string]string) (placementPolicy, []string) {
+	policy := clusterPlacementPolicy(config.GetPlacement())
+	problems := []string{}
+	layers := []struct {
+		annotations map[string]string
+		source      placementSource
+	}{
+		{getNamespaceAnnotations(namespace), sourceNamespace},
+		{deploymentAnnotations, sourceDeployment},
+		{podAnnotations, sourcePodTemplate},
+	}
+	for _, layer := range layers {
+		var layerProblems []string
+		policy, layerProblems = policy.withAnnotations(layer.annotations, layer.source)
+		problems = append(problems, layerProblems...)
+	}
+	return policy, problems
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"testing"
+
+	"practices/admission-prac/pkg/config"
+)
+
+func setNamespaceAnnotations(namespace string, annotations map[string]string) {
+	namespaceAnnotationsLock.Lock()
+	defer namespaceAnnotationsLock.Unlock()
+	namespaceAnnotations[namespace] = annotations
+}
+
+func TestResolvePlacementPolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Placement.OnDemandReplicas = 1
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	tests := []struct {
+		name                  string
+		namespaceAnnotations  map[string]string
+		deploymentAnnotations map[string]string
+		podAnnotations        map[string]string
+		want                  placementPolicy
+		wantProblems          int
+	}{
+		{
+			name: "cluster default",
+			want: placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, Source: sourceCluster},
+		},
+		{
+			name:                 "namespace overrides cluster",
+			namespaceAnnotations: map[string]string{OnDemandReplicasAnnotation: "2"},
+			want:                 placementPolicy{Mode: placementCounted, OnDemandReplicas: 2, Source: sourceNamespace},
+		},
+		{
+			name:                  "deployment overrides namespace",
+			namespaceAnnotations:  map[string]string{PlacementAnnotation: string(placementAllSpot)},
+			deploymentAnnotations: map[string]string{OnDemandReplicasAnnotation: "3"},
+			want:                  placementPolicy{Mode: placementCounted, OnDemandReplicas: 3, Source: sourceDeployment},
+		},
+		{
+			name:                  "pod template overrides deployment",
+			deploymentAnnotations: map[string]string{OnDemandReplicasAnnotation: "3"},
+			podAnnotations:        map[string]string{PlacementAnnotation: string(placementAllOnDemand)},
+			want:                  placementPolicy{Mode: placementAllOnDemand, OnDemandReplicas: 3, Source: sourcePodTemplate},
+		},
+		{
+			name:                  "invalid layer is skipped",
+			namespaceAnnotations:  map[string]string{OnDemandReplicasAnnotation: "2"},
+			deploymentAnnotations: map[string]string{OnDemandReplicasAnnotation: "-1"},
+			want:                  placementPolicy{Mode: placementCounted, OnDemandReplicas: 2, Source: sourceNamespace},
+			wantProblems:          1,
+		},
+		{
+			name:                 "skip is only allowed on workloads",
+			namespaceAnnotations: map[string]string{PlacementAnnotation: string(placementSkip)},
+			want:                 placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, Source: sourceCluster},
+			wantProblems:         1,
+		},
+		{
+			name:                  "deployment skips",
+			deploymentAnnotations: map[string]string{PlacementAnnotation: string(placementSkip)},
+			want:                  placementPolicy{Mode: placementSkip, OnDemandReplicas: 1, Source: sourceDeployment},
+		},
+		{
+			name:                  "per zone replaces the replicas",
+			deploymentAnnotations: map[string]string{OnDemandPerZoneAnnotation: "1"},
+			want:                  placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, OnDemandPerZone: 1, ZoneSpread: true, Source: sourceDeployment},
+		},
+		{
+			name:                  "replicas after per zone of a lower layer",
+			namespaceAnnotations:  map[string]string{OnDemandPerZoneAnnotation: "1"},
+			deploymentAnnotations: map[string]string{OnDemandReplicasAnnotation: "2", OnDemandSpreadAnnotation: spreadNone},
+			want:                  placementPolicy{Mode: placementCounted, OnDemandReplicas: 2, Source: sourceDeployment},
+		},
+		{
+			name:                 "audit from the namespace",
+			namespaceAnnotations: map[string]string{AuditAnnotation: "true"},
+			want:                 placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, Source: sourceCluster, Audit: true},
+		},
+		{
+			name:                 "audit is not allowed on workloads",
+			namespaceAnnotations: map[string]string{AuditAnnotation: "true"},
+			podAnnotations:       map[string]string{AuditAnnotation: "false"},
+			want:                 placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, Source: sourceCluster, Audit: true},
+			wantProblems:         1,
+		},
+		{
+			name:                  "spot degraded only from the deployment",
+			deploymentAnnotations: map[string]string{SpotDegradedAnnotation: "2024-01-01T00:00:00Z"},
+			podAnnotations:        map[string]string{SpotDegradedAnnotation: "2024-01-01T00:00:00Z"},
+			want:                  placementPolicy{Mode: placementCounted, OnDemandReplicas: 1, Source: sourceCluster, SpotDegraded: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setNamespaceAnnotations("test", tt.namespaceAnnotations)
+			got, problems := resolvePlacementPolicy("test", tt.deploymentAnnotations, tt.podAnnotations)
+			if got != tt.want {
+				t.Errorf("resolvePlacementPolicy() = %+v, want %+v", got, tt.want)
+			}
+			if len(problems) != tt.wantProblems {
+				t.Errorf("resolvePlacementPolicy() problems = %v, want %d", problems, tt.wantProblems)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"fmt"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	listersschedulingv1 "k8s.io/client-go/listers/scheduling/v1"
+)
+
+var (
+	priorityClassLister listersschedulingv1.PriorityClassLister
+)
+
+// priorityPatchOperations sets the priority class mapped to the kind, so spot pods are preempted first.
+// The priority resolved from the previous class is removed, the priority admission plugin resolves it again
+// on reinvocation. A class the workload chose itself is kept
+func priorityPatchOperations(pod corev1.Pod, kind NodeKind) ([]PatchOperation, string) {
+	priority := config.GetConfig().Priority
+	if !priority.Enabled || priorityClassLister == nil {
+		return nil, ""
+	}
+	name := ""
+	ours := false
+	for _, class := range priority.Classes {
+		if class.Tier == string(kind) {
+			name = class.Name
+		}
+		if class.Name == pod.Spec.PriorityClassName {
+			ours = true
+		}
+	}
+	if name == "" || name == pod.Spec.PriorityClassName {
+		return nil, ""
+	}
+	if pod.Spec.PriorityClassName != "" && !ours {
+		return nil, ""
+	}
+	if _, err := priorityClassLister.Get(name); err != nil {
+		return nil, fmt.Sprintf("priority class %s for %s pods not found, priority left unchanged", name, kind)
+	}
+	patchOperations := []PatchOperation{
+		{
+			Operation: "add",
+			Path:      "/spec/priorityClassName",
+			Value:     name,
+		},
+	}
+	if pod.Spec.Priority != nil {
+		patchOperations = append(patchOperations, PatchOperation{Operation: "remove", Path: "/spec/priority"})
+	}
+	if pod.Spec.PreemptionPolicy != nil {
+		patchOperations = append(patchOperations, PatchOperation{Operation: "remove", Path: "/spec/preemptionPolicy"})
+	}
+	return patchOperations, ""
+}
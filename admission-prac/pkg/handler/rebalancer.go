@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type RebalancerParameters struct {
+	// Interval is how often all replicasets are checked, pod changes trigger a check right away
+	Interval time.Duration
+	// Cooldown is how long a replicaset is left alone after one of its pods was evicted
+	Cooldown           time.Duration
+	EvictionsPerMinute int
+	// InterruptionsOnly only replaces on-demand pods on nodes being interrupted, with periodic rebalancing off
+	// the interruption reaction still needs the worker
+	InterruptionsOnly bool
+}
+
+var (
+	// a replicaset blocked by a poddisruptionbudget is retried with backoff
+	rebalanceQueue = workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Second, 10*time.Minute), "rebalancer")
+	rebalancerRunning int32
+)
+
+type rebalancer struct {
+	parameters RebalancerParameters
+	// evictionLimiter limits evictions over all replicasets
+	evictionLimiter flowcontrol.RateLimiter
+	lock            sync.Mutex
+	lastEvictions   map[types.UID]time.Time
+}
+
+// enqueueRebalance asks the rebalancer to check the replicaset, it does nothing while the rebalancer is off
+func enqueueRebalance(replicasetUID types.UID) {
+	if atomic.LoadInt32(&rebalancerRunning) == 1 {
+		rebalanceQueue.Add(replicasetUID)
+	}
+}
+
+// StartRebalancer restores the on-demand pod of replicasets that lost it to an eviction or a drained node,
+// it evicts one spot pod so its replacement is admitted as on-demand. It runs until stopCh is closed
+func StartRebalancer(parameters RebalancerParameters, stopCh <-chan struct{}) {
+	if parameters.InterruptionsOnly {
+		logrus.Println("starting rebalancer for interrupted nodes only")
+	} else {
+		logrus.Println("starting rebalancer")
+	}
+	r := &rebalancer{
+		parameters:      parameters,
+		evictionLimiter: flowcontrol.NewTokenBucketRateLimiter(float32(parameters.EvictionsPerMinute)/60, 1),
+		lastEvictions:   make(map[types.UID]time.Time),
+	}
+	defer rebalanceQueue.ShutDown()
+
+	// decisions on a cold cache would evict pods of replicasets whose on-demand pod is just not seen yet
+	if err := wait.PollImmediateUntil(time.Second, func() (bool, error) { return hasInformersSynced(), nil }, stopCh); err != nil {
+		logrus.Debug("rebalancer stopped before informers synced")
+		return
+	}
+	atomic.StoreInt32(&rebalancerRunning, 1)
+
+	// interruptions are enqueued by the node informer, there is nothing to check periodically
+	if !parameters.InterruptionsOnly {
+		go wait.Until(func() {
+			for _, replicasetUID := range cachedReplicasets() {
+				rebalanceQueue.Add(replicasetUID)
+			}
+		}, parameters.Interval, stopCh)
+	}
+	go wait.Until(r.runWorker, time.Second, stopCh)
+	<-stopCh
+	logrus.Debug("rebalancer stopped")
+}
+
+func (r *rebalancer) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *rebalancer) processNextItem() bool {
+	key, quit := rebalanceQueue.Get()
+	if quit {
+		return false
+	}
+	defer rebalanceQueue.Done(key)
+
+	replicasetUID := key.(types.UID)
+	requeueAfter, err := r.reconcile(replicasetUID)
+	if err != nil {
+		logrus.WithField("replicaset", replicasetUID).WithError(err).Warn("rebalance replicaset err, backing off")
+		rebalanceQueue.AddRateLimited(key)
+		return true
+	}
+	rebalanceQueue.Forget(key)
+	if requeueAfter > 0 {
+		rebalanceQueue.AddAfter(key, requeueAfter)
+	}
+	return true
+}
+
+// reconcile evicts one spot pod of the replicaset when none of its live pods is on-demand,
+// or its on-demand pod when that is on a node being interrupted.
+// It only acts on settled replicasets, all desired pods live and ready, so rollouts and scaling are left alone
+func (r *rebalancer) reconcile(replicasetUID types.UID) (time.Duration, error) {
+	deployment, ok := getReplicasetDeployment(replicasetUID)
+	if !ok {
+		r.lock.Lock()
+		delete(r.lastEvictions, replicasetUID)
+		r.lock.Unlock()
+		return 0, nil
+	}
+	replicas, ok := getReplicasetReplicas(replicasetUID)
+	if !ok || replicas == 0 {
+		return 0, nil
+	}
+	livePods := []corev1.Pod{}
+	for _, pod := range podsOfReplicaset(replicasetUID) {
+		if podIsLive(pod) {
+			livePods = append(livePods, pod)
+		}
+	}
+	if len(livePods) != int(replicas) {
+		return 0, nil
+	}
+
+	policy, _ := resolvePlacementPolicy(deployment.Namespace, getReplicasetDeploymentAnnotations(replicasetUID), livePods[0].Annotations)
+	if policy.Mode != placementCounted || policy.Audit || policy.OnDemandReplicas == 0 {
+		return 0, nil
+	}
+
+	placement := config.GetPlacement()
+	spotPods := []corev1.Pod{}
+	interruptedOnDemandPods := []corev1.Pod{}
+	for _, pod := range livePods {
+		if !podIsReady(pod) {
+			return 0, nil
+		}
+		if podHasOnDemandNodeAffinity(pod, placement) {
+			// an on-demand pod on an interrupted node is about to go, it is replaced before the node disappears
+			if isNodeInterrupted(pod.Spec.NodeName) {
+				interruptedOnDemandPods = append(interruptedOnDemandPods, pod)
+				continue
+			}
+			return 0, nil
+		}
+		if podHasSpotNodeAffinity(pod, placement) {
+			spotPods = append(spotPods, pod)
+		}
+	}
+	if r.parameters.InterruptionsOnly && len(interruptedOnDemandPods) == 0 {
+		return 0, nil
+	}
+	candidates := spotPods
+	if len(interruptedOnDemandPods) > 0 {
+		candidates = interruptedOnDemandPods
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	// the replacement of an evicted spot pod would go to spot again while the budget is exhausted
+	if len(interruptedOnDemandPods) == 0 && onDemandBudgetProblem(deployment.Namespace, spotPods[0]) != "" {
+		return 0, nil
+	}
+
+	r.lock.Lock()
+	lastEviction, evicted := r.lastEvictions[replicasetUID]
+	r.lock.Unlock()
+	if evicted {
+		if wait := r.parameters.Cooldown - time.Since(lastEviction); wait > 0 {
+			return wait, nil
+		}
+	}
+	if !r.evictionLimiter.TryAccept() {
+		return time.Minute / time.Duration(r.parameters.EvictionsPerMinute), nil
+	}
+
+	// a pod on an interrupted node goes anyway, else the youngest pod has the least warmed up state to lose
+	sort.Slice(candidates, func(i, j int) bool {
+		interruptedI, interruptedJ := isNodeInterrupted(candidates[i].Spec.NodeName), isNodeInterrupted(candidates[j].Spec.NodeName)
+		if interruptedI != interruptedJ {
+			return interruptedI
+		}
+		return candidates[j].CreationTimestamp.Before(&candidates[i].CreationTimestamp)
+	})
+	pod := candidates[0]
+	reason := "no live on-demand pod left"
+	if len(interruptedOnDemandPods) > 0 {
+		reason = fmt.Sprintf("on-demand node %s is being interrupted", pod.Spec.NodeName)
+	}
+	target := deploymentReferenceOf(deployment)
+	eviction := &policyv1.Eviction{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	err := clientset.GetClientset().CoreV1().Pods(pod.Namespace).EvictV1(context.TODO(), eviction)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if apierrors.IsTooManyRequests(err) {
+		recordPodEvent(target, corev1.EventTypeWarning, reasonRebalanceBlocked,
+			"%s, evicting pod %s is blocked by a poddisruptionbudget, retrying", reason, pod.Name)
+		return 0, fmt.Errorf("evict pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("evict pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	r.lock.Lock()
+	r.lastEvictions[replicasetUID] = time.Now()
+	r.lock.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"deployment": deployment.key(),
+		"pod":        pod.Name,
+		"reason":     reason,
+	}).Println("evicted a pod so its replacement is placed on on-demand nodes")
+	recordPodEvent(target, corev1.EventTypeNormal, reasonRebalanceEvicted,
+		"%s, evicted pod %s so its replacement is placed on on-demand nodes", reason, pod.Name)
+	return 0, nil
+}
+
+func podIsReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"practices/admission-prac/pkg/config"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CapacityLabel is set on every patched pod, it tells the capacity the pod was sent to
+// so spread constraints can select the spot pods of a replicaset
+const CapacityLabel = annotationPrefix + "capacity"
+
+// spotSpreadConstraintsOf builds the configured spread constraints for a spot pod, scoped to the spot pods
+// of its replicaset. Topology keys the pod already spreads over are left to the user's constraints
+func spotSpreadConstraintsOf(pod corev1.Pod, placement config.PlacementConfig) []corev1.TopologySpreadConstraint {
+	templateHash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if !ok {
+		return nil
+	}
+	userKeys := make(map[string]bool)
+	for _, constraint := range pod.Spec.TopologySpreadConstraints {
+		userKeys[constraint.TopologyKey] = true
+	}
+	constraints := []corev1.TopologySpreadConstraint{}
+	for _, spread := range placement.SpotSpread {
+		if userKeys[spread.TopologyKey] {
+			continue
+		}
+		constraints = append(constraints, corev1.TopologySpreadConstraint{
+			MaxSkew:           spread.MaxSkew,
+			TopologyKey:       spread.TopologyKey,
+			WhenUnsatisfiable: corev1.UnsatisfiableConstraintAction(spread.WhenUnsatisfiable),
+			LabelSelector: &v1.LabelSelector{
+				MatchLabels: map[string]string{
+					appsv1.DefaultDeploymentUniqueLabelKey: templateHash,
+					CapacityLabel:                          string(NodeSpot),
+				},
+			},
+		})
+	}
+	return constraints
+}
+
+// spreadPatchOperations appends the constraints to those of the pod, the list itself is added when the pod has none
+func spreadPatchOperations(pod corev1.Pod, constraints []corev1.TopologySpreadConstraint) []PatchOperation {
+	if len(constraints) == 0 {
+		return nil
+	}
+	if len(pod.Spec.TopologySpreadConstraints) == 0 {
+		return []PatchOperation{
+			{
+				Operation: "add",
+				Path:      "/spec/topologySpreadConstraints",
+				Value:     constraints,
+			},
+		}
+	}
+	patchOperations := []PatchOperation{}
+	for _, constraint := range constraints {
+		patchOperations = append(patchOperations, PatchOperation{
+			Operation: "add",
+			Path:      "/spec/topologySpreadConstraints/-",
+			Value:     constraint,
+		})
+	}
+	return patchOperations
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"sort"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func tierOf(placement config.PlacementConfig, kind NodeKind) (config.TierConfig, bool) {
+	for _, tier := range placement.EffectiveTiers() {
+		if tier.Name == string(kind) {
+			return tier, true
+		}
+	}
+	return config.TierConfig{}, false
+}
+
+// tierMatches tells if node labels match the node selector of the tier
+func tierMatches(tier config.TierConfig, labels map[string]string) bool {
+	for key, value := range tier.NodeSelector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeTierOf is the first tier the node labels match
+func nodeTierOf(labels map[string]string, placement config.PlacementConfig) (NodeKind, bool) {
+	for _, tier := range placement.EffectiveTiers() {
+		if tierMatches(tier, labels) {
+			return NodeKind(tier.Name), true
+		}
+	}
+	return "", false
+}
+
+// podHasTierNodeAffinity tells if a required node selector term of the pod asks for every label of the tier
+func podHasTierNodeAffinity(pod corev1.Pod, tier config.TierConfig) bool {
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	for _, term := range pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		matched := 0
+		for key, value := range tier.NodeSelector {
+			for _, expression := range term.MatchExpressions {
+				if expression.Key == key && expression.Operator == corev1.NodeSelectorOpIn && len(expression.Values) == 1 && expression.Values[0] == value {
+					matched++
+					break
+				}
+			}
+		}
+		if matched == len(tier.NodeSelector) {
+			return true
+		}
+	}
+	return false
+}
+
+// podTierOf is the first tier the node affinity of the pod asks for, empty when none
+func podTierOf(pod corev1.Pod, tiers []config.TierConfig) NodeKind {
+	for _, tier := range tiers {
+		if podHasTierNodeAffinity(pod, tier) {
+			return NodeKind(tier.Name)
+		}
+	}
+	return ""
+}
+
+// tierQuotaOf is how many pods of the replicaset go to the tier, false when the tier has no limit
+func tierQuotaOf(tier config.TierConfig, policy placementPolicy, replicas int) (int, bool) {
+	if tier.Name == string(NodeOnDemand) {
+		return policy.onDemandWanted(), true
+	}
+	// validated with the config
+	quota, limited, _ := tier.QuotaOf(replicas)
+	return quota, limited
+}
+
+// tierNodeAffinityOf requires the labels of the tier, sorted so the patch is the same for the same tier
+func tierNodeAffinityOf(tier config.TierConfig) corev1.NodeAffinity {
+	keys := make([]string, 0, len(tier.NodeSelector))
+	for key := range tier.NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expressions := []corev1.NodeSelectorRequirement{}
+	for _, key := range keys {
+		expressions = append(expressions, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{tier.NodeSelector[key]},
+		})
+	}
+	return corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{
+					MatchExpressions: expressions,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const tierReserved = "reserved"
+
+func tieredPlacement() config.PlacementConfig {
+	placement := config.Default().Placement
+	placement.Tiers = []config.TierConfig{
+		{Name: config.CapacityOnDemand, NodeSelector: map[string]string{"pool": "on-demand"}},
+		{Name: tierReserved, NodeSelector: map[string]string{"pool": "reserved"}, Quota: "50%"},
+		{Name: config.CapacitySpot, NodeSelector: map[string]string{"pool": "spot"}},
+	}
+	return placement
+}
+
+func TestTierQuotaOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		tier        config.TierConfig
+		policy      placementPolicy
+		replicas    int
+		want        int
+		wantLimited bool
+	}{
+		{
+			name:        "on-demand takes the policy replicas",
+			tier:        config.TierConfig{Name: config.CapacityOnDemand},
+			policy:      placementPolicy{OnDemandReplicas: 2},
+			replicas:    10,
+			want:        2,
+			wantLimited: true,
+		},
+		{
+			name:        "on-demand takes nothing for all spot",
+			tier:        config.TierConfig{Name: config.CapacityOnDemand},
+			policy:      placementPolicy{Mode: placementAllSpot, OnDemandReplicas: 2},
+			replicas:    10,
+			want:        0,
+			wantLimited: true,
+		},
+		{
+			name:        "percentage of the replicas",
+			tier:        config.TierConfig{Name: tierReserved, Quota: "30%"},
+			policy:      placementPolicy{OnDemandReplicas: 2},
+			replicas:    10,
+			want:        3,
+			wantLimited: true,
+		},
+		{
+			name:     "no quota",
+			tier:     config.TierConfig{Name: config.CapacitySpot},
+			replicas: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, limited := tierQuotaOf(tt.tier, tt.policy, tt.replicas)
+			if got != tt.want || limited != tt.wantLimited {
+				t.Errorf("tierQuotaOf() = %d, %v, want %d, %v", got, limited, tt.want, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func tierPod(uid string, tier config.TierConfig) corev1.Pod {
+	affinity := tierNodeAffinityOf(tier)
+	return corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: uid, UID: types.UID(uid)},
+		Spec:       corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &affinity}},
+	}
+}
+
+func TestSetNodeAffinityFillsTiers(t *testing.T) {
+	cfg := config.Default()
+	cfg.Placement = tieredPlacement()
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+	tiers := cfg.Placement.Tiers
+
+	tests := []struct {
+		name     string
+		replicas int32
+		// cached is how many live pods of the replicaset each tier already has
+		cached map[string]int
+		want   NodeKind
+	}{
+		{
+			name:     "on-demand first",
+			replicas: 4,
+			want:     NodeOnDemand,
+		},
+		{
+			name:     "reserved after on-demand",
+			replicas: 4,
+			cached:   map[string]int{config.CapacityOnDemand: 1},
+			want:     NodeKind(tierReserved),
+		},
+		{
+			name:     "reserved up to its quota",
+			replicas: 4,
+			cached:   map[string]int{config.CapacityOnDemand: 1, tierReserved: 1},
+			want:     NodeKind(tierReserved),
+		},
+		{
+			name:     "spot takes the rest",
+			replicas: 4,
+			cached:   map[string]int{config.CapacityOnDemand: 1, tierReserved: 2},
+			want:     NodeSpot,
+		},
+		{
+			name:     "replicaset not cached goes by the pods seen",
+			replicas: 0,
+			cached:   map[string]int{config.CapacityOnDemand: 1, tierReserved: 1, config.CapacitySpot: 1},
+			want:     NodeKind(tierReserved),
+		},
+		{
+			name:     "lagging replicas go by the pods seen",
+			replicas: 2,
+			cached:   map[string]int{config.CapacityOnDemand: 1, tierReserved: 2, config.CapacitySpot: 2},
+			want:     NodeKind(tierReserved),
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicasetUID := types.UID(fmt.Sprintf("replicaset-%d", i))
+			podCachemap := make(PodCachemap)
+			for _, tier := range tiers {
+				for n := 0; n < tt.cached[tier.Name]; n++ {
+					pod := tierPod(fmt.Sprintf("%s-%s-%d", replicasetUID, tier.Name, n), tier)
+					podCachemap[pod.UID] = pod
+				}
+			}
+			replicasetCacheLock.Lock()
+			replicasetCache[replicasetUID] = podCachemap
+			replicasetCacheLock.Unlock()
+			workloadLock.Lock()
+			if tt.replicas > 0 {
+				replicasetReplicas[replicasetUID] = tt.replicas
+			}
+			workloadLock.Unlock()
+
+			got, _ := setNodeAffinity(replicasetUID, placementPolicy{OnDemandReplicas: 1})
+			if got != tt.want {
+				t.Errorf("setNodeAffinity() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	admission "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	policylisters "k8s.io/client-go/listers/policy/v1"
+)
+
+var (
+	pdbLister policylisters.PodDisruptionBudgetLister
+	// the default maxUnavailable of a rolling update
+	defaultMaxUnavailable = intstr.FromString("25%")
+)
+
+// validateDeployment never changes a deployment, it checks its placement annotations and whether
+// the placement of its pods makes it fragile. The findings are warnings, in strict mode they deny it.
+// Problems of the annotations are only warnings, the pods fall back to the namespace or cluster default.
+// Strict mode only denies creating a deployment or changing its spec, see strictlyValidated
+func validateDeployment(admissionReviewFromRequest admission.AdmissionReview) (admission.AdmissionReview, error) {
+	raw := admissionReviewFromRequest.Request.Object.Raw
+	deployment := appsv1.Deployment{}
+	if _, _, err := UniversalDeserializer.Decode(raw, nil, &deployment); err != nil {
+		logrus.Errorf("decode object to deployment err: %v", err)
+		return admission.AdmissionReview{}, err
+	}
+	namespace := admissionReviewFromRequest.Request.Namespace
+	policy, problems := resolvePlacementPolicy(namespace, deployment.Annotations, deployment.Spec.Template.Annotations)
+	findings := fragilityOf(deployment, namespace, policy)
+	for _, finding := range findings {
+		logrus.WithField("deployment", namespace+"/"+deployment.Name).Infoln(finding)
+	}
+	if len(findings) > 0 && config.GetPlacement().StrictValidation && strictlyValidated(admissionReviewFromRequest.Request, deployment) {
+		admissionReviewToResponse := buildAllowedAdmissionReview(admissionReviewFromRequest, problems)
+		admissionReviewToResponse.Response.Allowed = false
+		admissionReviewToResponse.Response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: "fragile with spot placement: " + strings.Join(findings, "; "),
+		}
+		return admissionReviewToResponse, nil
+	}
+	return buildAllowedAdmissionReview(admissionReviewFromRequest, append(problems, findings...)), nil
+}
+
+// strictlyValidated tells whether strict mode may deny the request. Our own requests, like the spot fallback
+// marking a deployment degraded, and changes leaving the spec alone, like its annotations or labels,
+// are never denied, an already fragile deployment could not be touched otherwise
+func strictlyValidated(request *admission.AdmissionRequest, deployment appsv1.Deployment) bool {
+	if own := clientset.GetUsername(); own != "" && request.UserInfo.Username == own {
+		return false
+	}
+	switch request.Operation {
+	case admission.Create:
+		return true
+	case admission.Update:
+		old := appsv1.Deployment{}
+		if _, _, err := UniversalDeserializer.Decode(request.OldObject.Raw, nil, &old); err != nil {
+			logrus.Errorf("decode old object to deployment err: %v", err)
+			return true
+		}
+		return !equality.Semantic.DeepEqual(old.Spec, deployment.Spec)
+	}
+	return false
+}
+
+// fragilityOf checks replicas, rollout strategy and poddisruptionbudgets against how many pods go to on-demand nodes
+func fragilityOf(deployment appsv1.Deployment, namespace string, policy placementPolicy) []string {
+	findings := []string{}
+	if policy.Mode == placementSkip || policy.Mode == placementAllOnDemand {
+		return findings
+	}
+	replicas := 1
+	if deployment.Spec.Replicas != nil {
+		replicas = int(*deployment.Spec.Replicas)
+	}
+	if replicas == 0 {
+		return findings
+	}
+	onDemand := policy.onDemandWanted()
+	if onDemand > replicas {
+		onDemand = replicas
+	}
+	spot := replicas - onDemand
+
+	if spot == 0 {
+		findings = append(findings, fmt.Sprintf("all %d replicas run on on-demand nodes, on-demand replicas is %d, nothing runs on spot", replicas, policy.onDemandWanted()))
+		return findings
+	}
+	if onDemand == 0 {
+		findings = append(findings, fmt.Sprintf("all %d replicas run on spot nodes, losing the spot nodes takes the whole deployment down", replicas))
+	}
+
+	switch deployment.Spec.Strategy.Type {
+	case appsv1.RecreateDeploymentStrategyType:
+		if onDemand > 0 {
+			findings = append(findings, "the Recreate strategy stops the on-demand pods together with the spot pods on every rollout")
+		}
+	default:
+		maxUnavailable := &defaultMaxUnavailable
+		if deployment.Spec.Strategy.RollingUpdate != nil && deployment.Spec.Strategy.RollingUpdate.MaxUnavailable != nil {
+			maxUnavailable = deployment.Spec.Strategy.RollingUpdate.MaxUnavailable
+		}
+		unavailable, err := intstr.GetScaledValueFromIntOrPercent(maxUnavailable, replicas, false)
+		if err != nil {
+			findings = append(findings, fmt.Sprintf("invalid maxUnavailable %s: %v", maxUnavailable.String(), err))
+		} else if onDemand > 0 && unavailable > spot {
+			findings = append(findings, fmt.Sprintf("maxUnavailable %s allows %d of %d pods down during a rollout, more than the %d spot pods, the on-demand pods can go down with them",
+				maxUnavailable.String(), unavailable, replicas, spot))
+		}
+	}
+
+	findings = append(findings, pdbFragilityOf(deployment, namespace, replicas, onDemand)...)
+	return findings
+}
+
+// pdbFragilityOf finds poddisruptionbudgets the on-demand pods alone can't satisfy,
+// reclaiming the spot nodes then breaks them and they block draining nodes
+func pdbFragilityOf(deployment appsv1.Deployment, namespace string, replicas, onDemand int) []string {
+	findings := []string{}
+	if pdbLister == nil {
+		return findings
+	}
+	pdbs, err := pdbLister.PodDisruptionBudgets(namespace).List(labels.Everything())
+	if err != nil {
+		logrus.WithField("namespace", namespace).WithError(err).Warn("list poddisruptionbudgets from cache err")
+		return findings
+	}
+	podLabels := labels.Set(deployment.Spec.Template.Labels)
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() || !selector.Matches(podLabels) {
+			continue
+		}
+		if pdb.Spec.MinAvailable != nil {
+			minAvailable, err := intstr.GetScaledValueFromIntOrPercent(pdb.Spec.MinAvailable, replicas, true)
+			if err == nil && minAvailable > onDemand {
+				findings = append(findings, fmt.Sprintf("poddisruptionbudget %s needs %d pods available but only %d run on on-demand nodes, losing the spot nodes breaks it",
+					pdb.Name, minAvailable, onDemand))
+			}
+		}
+		if pdb.Spec.MaxUnavailable != nil {
+			maxUnavailable, err := intstr.GetScaledValueFromIntOrPercent(pdb.Spec.MaxUnavailable, replicas, true)
+			if err == nil && replicas-onDemand > maxUnavailable {
+				findings = append(findings, fmt.Sprintf("poddisruptionbudget %s allows %d pods unavailable but %d run on spot nodes, losing the spot nodes breaks it",
+					pdb.Name, maxUnavailable, replicas-onDemand))
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	policylisters "k8s.io/client-go/listers/policy/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testDeployment(replicas int32, strategy appsv1.DeploymentStrategy) appsv1.Deployment {
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "app"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Strategy: strategy,
+		},
+	}
+	deployment.Spec.Template.Labels = map[string]string{"app": "app"}
+	return deployment
+}
+
+func testPDB(name string, minAvailable, maxUnavailable *intstr.IntOrString) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}},
+			MinAvailable:   minAvailable,
+			MaxUnavailable: maxUnavailable,
+		},
+	}
+}
+
+func TestFragilityOf(t *testing.T) {
+	one := intstr.FromInt(1)
+	three := intstr.FromInt(3)
+	half := intstr.FromString("50%")
+	rollingUpdate := func(maxUnavailable intstr.IntOrString) appsv1.DeploymentStrategy {
+		return appsv1.DeploymentStrategy{
+			Type:          appsv1.RollingUpdateDeploymentStrategyType,
+			RollingUpdate: &appsv1.RollingUpdateDeployment{MaxUnavailable: &maxUnavailable},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		deployment   appsv1.Deployment
+		policy       placementPolicy
+		pdbs         []*policyv1.PodDisruptionBudget
+		wantFindings int
+	}{
+		{
+			name:       "robust",
+			deployment: testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{OnDemandReplicas: 1},
+		},
+		{
+			name:       "skipped",
+			deployment: testDeployment(1, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{Mode: placementSkip},
+		},
+		{
+			name:       "all on-demand by choice",
+			deployment: testDeployment(1, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{Mode: placementAllOnDemand},
+		},
+		{
+			name:       "scaled to zero",
+			deployment: testDeployment(0, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{Mode: placementAllSpot},
+		},
+		{
+			name:         "all replicas on on-demand",
+			deployment:   testDeployment(1, appsv1.DeploymentStrategy{}),
+			policy:       placementPolicy{OnDemandReplicas: 1},
+			wantFindings: 1,
+		},
+		{
+			name:         "all replicas on spot",
+			deployment:   testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:       placementPolicy{Mode: placementAllSpot},
+			wantFindings: 1,
+		},
+		{
+			name:         "recreate",
+			deployment:   testDeployment(4, appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}),
+			policy:       placementPolicy{OnDemandReplicas: 1},
+			wantFindings: 1,
+		},
+		{
+			name:         "max unavailable over the spot pods",
+			deployment:   testDeployment(4, rollingUpdate(intstr.FromString("100%"))),
+			policy:       placementPolicy{OnDemandReplicas: 1},
+			wantFindings: 1,
+		},
+		{
+			name:       "max unavailable within the spot pods",
+			deployment: testDeployment(4, rollingUpdate(half)),
+			policy:     placementPolicy{OnDemandReplicas: 1},
+		},
+		{
+			name:         "pdb min available over the on-demand pods",
+			deployment:   testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:       placementPolicy{OnDemandReplicas: 1},
+			pdbs:         []*policyv1.PodDisruptionBudget{testPDB("min", &half, nil)},
+			wantFindings: 1,
+		},
+		{
+			name:       "pdb min available within the on-demand pods",
+			deployment: testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{OnDemandReplicas: 1},
+			pdbs:       []*policyv1.PodDisruptionBudget{testPDB("min", &one, nil)},
+		},
+		{
+			name:         "pdb max unavailable under the spot pods",
+			deployment:   testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:       placementPolicy{OnDemandReplicas: 1},
+			pdbs:         []*policyv1.PodDisruptionBudget{testPDB("max", nil, &one)},
+			wantFindings: 1,
+		},
+		{
+			name:       "pdb max unavailable covers the spot pods",
+			deployment: testDeployment(4, appsv1.DeploymentStrategy{}),
+			policy:     placementPolicy{OnDemandReplicas: 1},
+			pdbs:       []*policyv1.PodDisruptionBudget{testPDB("max", nil, &three)},
+		},
+	}
+	defer func() { pdbLister = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, pdb := range tt.pdbs {
+				if err := indexer.Add(pdb); err != nil {
+					t.Fatalf("add poddisruptionbudget: %v", err)
+				}
+			}
+			pdbLister = policylisters.NewPodDisruptionBudgetLister(indexer)
+			findings := fragilityOf(tt.deployment, "test", tt.policy)
+			if len(findings) != tt.wantFindings {
+				t.Errorf("fragilityOf() = %v, want %d findings", findings, tt.wantFindings)
+			}
+		})
+	}
+}
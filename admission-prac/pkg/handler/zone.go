@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"sort"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// availableZones lists the zones with an available node of the kind, sorted so ties are broken the same way
+func availableZones(kind NodeKind) []string {
+	tier, ok := tierOf(config.GetPlacement(), kind)
+	if !ok {
+		return nil
+	}
+	availabilityLock.RLock()
+	seen := make(map[string]bool)
+	for _, labels := range availableNodes {
+		if zone := labels[corev1.LabelTopologyZone]; zone != "" && tierMatches(tier, labels) {
+			seen[zone] = true
+		}
+	}
+	availabilityLock.RUnlock()
+	zones := make([]string, 0, len(seen))
+	for zone := range seen {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// onDemandWanted is how many pods of a replicaset go to on-demand nodes, per zone it grows with the zones
+func (p placementPolicy) onDemandWanted() int {
+	if p.Mode == placementAllSpot {
+		return 0
+	}
+	if p.OnDemandPerZone > 0 {
+		zones := len(availableZones(NodeOnDemand))
+		if zones == 0 {
+			// zones are not known yet or nodes carry no zone label, the cluster counts as one zone
+			zones = 1
+		}
+		return p.OnDemandPerZone * zones
+	}
+	return p.OnDemandReplicas
+}
+
+// podPlacedZoneOf is the zone of the node the pod runs on, or the zone its node affinity asks for
+func podPlacedZoneOf(pod corev1.Pod) string {
+	if pod.Spec.NodeName != "" && nodeLister != nil {
+		if node, err := nodeLister.Get(pod.Spec.NodeName); err == nil {
+			return node.Labels[corev1.LabelTopologyZone]
+		}
+	}
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+	for _, term := range pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == corev1.LabelTopologyZone && expression.Operator == corev1.NodeSelectorOpIn && len(expression.Values) == 1 {
+				return expression.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// leastOnDemandZone picks the zone with the fewest on-demand pods, false when no zone is known
+// or every zone already has its share
+func leastOnDemandZone(onDemandPodsPerZone map[string]int, policy placementPolicy) (string, bool) {
+	zones := availableZones(NodeOnDemand)
+	chosen, fewest := "", -1
+	for _, zone := range zones {
+		if count := onDemandPodsPerZone[zone]; fewest < 0 || count < fewest {
+			chosen, fewest = zone, count
+		}
+	}
+	if chosen == "" || (policy.OnDemandPerZone > 0 && fewest >= policy.OnDemandPerZone) {
+		return "", false
+	}
+	return chosen, true
+}
+
+// withZone restricts the node affinity to the zone
+func withZone(nodeAffinity corev1.NodeAffinity, zone string) corev1.NodeAffinity {
+	terms := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, corev1.NodeSelectorRequirement{
+			Key:      corev1.LabelTopologyZone,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{zone},
+		})
+	}
+	return nodeAffinity
+}
@@ -0,0 +1,70 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type CheckStatus struct {
+	Ready   bool              `json:"ready"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type readyzResponse struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]CheckStatus `json:"checks"`
+}
+
+var (
+	lock   sync.RWMutex
+	checks = make(map[string]CheckStatus)
+)
+
+// SetCheck records the latest status of a named check, /readyz reports not ready while any check is not ready
+func SetCheck(name string, ready bool, details map[string]string) {
+	lock.Lock()
+	defer lock.Unlock()
+	checks[name] = CheckStatus{
+		Ready:   ready,
+		Details: details,
+	}
+}
+
+type readyzHandler struct {
+}
+
+func NewReadyzHandler() http.Handler {
+	return &readyzHandler{}
+}
+
+func (h *readyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := readyzResponse{
+		Ready:  true,
+		Checks: make(map[string]CheckStatus),
+	}
+	lock.RLock()
+	for name, check := range checks {
+		response.Checks[name] = check
+		if !check.Ready {
+			response.Ready = false
+		}
+	}
+	lock.RUnlock()
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		logrus.Errorf("json marshal readyz response err: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(responseBytes); err != nil {
+		logrus.WithError(err).Error("write readyz response err")
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// AuditDecisions counts pods placed in audit mode by the capacity decided for them and the capacity of the node they landed on
+	AuditDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_prac_audit_decisions_total",
+		Help: "Pods placed in audit mode, by the capacity type decided and the capacity type of the node they landed on.",
+	}, []string{"decided", "actual"})
+	// NodeInterruptions counts nodes seen being interrupted, by node pool and capacity type
+	NodeInterruptions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_prac_node_interruptions_total",
+		Help: "Nodes seen carrying an interruption signal, by node pool and capacity type.",
+	}, []string{"pool", "capacity"})
+	// AuditMismatches counts pods of audit mode landing on another capacity than decided
+	AuditMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "admission_prac_audit_mismatches_total",
+		Help: "Pods placed in audit mode that landed on a node of another capacity type than decided.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(AuditDecisions, AuditMismatches, NodeInterruptions)
+}
+
+func NewMetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -3,42 +3,110 @@ package mutatingwebhookconfiguration
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 
 	"practices/admission-prac/pkg/clientset"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var (
-	seconds30 = int32(30)
+	FieldManager = "admission-prac"
+	forceApply   = true
 )
 
 type MutatingWebhookConfigurationParameters struct {
 	ConfigurationName string
 	WebhookName       string
 	admissionregistrationv1.ServiceReference
+	// URL is used instead of the service reference when set, e.g. for a webhook running outside the cluster
+	URL                      string
 	FailurePolicy            admissionregistrationv1.FailurePolicyType
 	WebhookNamespaceSelector v1.LabelSelector
+	WebhookObjectSelector    v1.LabelSelector
+	Operations               []admissionregistrationv1.OperationType
+	TimeoutSeconds           int32
+	ReinvocationPolicy       admissionregistrationv1.ReinvocationPolicyType
+	MatchPolicy              admissionregistrationv1.MatchPolicyType
 	CACert                   *bytes.Buffer
 }
 
-func CreateMutateWebhookConfiguration(parameters MutatingWebhookConfigurationParameters) {
-	cfg := admissionregistrationv1.MutatingWebhookConfiguration{
+func ParseFailurePolicy(value string) (admissionregistrationv1.FailurePolicyType, error) {
+	switch policy := admissionregistrationv1.FailurePolicyType(value); policy {
+	case admissionregistrationv1.Fail, admissionregistrationv1.Ignore:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid failure policy %q, must be Fail or Ignore", value)
+}
+
+func ParseReinvocationPolicy(value string) (admissionregistrationv1.ReinvocationPolicyType, error) {
+	switch policy := admissionregistrationv1.ReinvocationPolicyType(value); policy {
+	case admissionregistrationv1.NeverReinvocationPolicy, admissionregistrationv1.IfNeededReinvocationPolicy:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid reinvocation policy %q, must be Never or IfNeeded", value)
+}
+
+func ParseMatchPolicy(value string) (admissionregistrationv1.MatchPolicyType, error) {
+	switch policy := admissionregistrationv1.MatchPolicyType(value); policy {
+	case admissionregistrationv1.Exact, admissionregistrationv1.Equivalent:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid match policy %q, must be Exact or Equivalent", value)
+}
+
+// ParseOperations parses a comma separated list like CREATE,UPDATE.
+// Pods are only mutated on CREATE, the other operations are allowed unchanged
+func ParseOperations(value string) ([]admissionregistrationv1.OperationType, error) {
+	operations := []admissionregistrationv1.OperationType{}
+	for _, item := range strings.Split(value, ",") {
+		switch operation := admissionregistrationv1.OperationType(strings.ToUpper(strings.TrimSpace(item))); operation {
+		case admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete, admissionregistrationv1.Connect, admissionregistrationv1.OperationAll:
+			operations = append(operations, operation)
+		default:
+			return nil, fmt.Errorf("invalid operation %q, must be one of CREATE, UPDATE, DELETE, CONNECT or *", item)
+		}
+	}
+	return operations, nil
+}
+
+// ValidateTimeoutSeconds checks the range the apiserver accepts
+func ValidateTimeoutSeconds(timeoutSeconds int32) error {
+	if timeoutSeconds < 1 || timeoutSeconds > 30 {
+		return fmt.Errorf("invalid timeout %d, must be between 1 and 30 seconds", timeoutSeconds)
+	}
+	return nil
+}
+
+func BuildMutatingWebhookConfiguration(parameters MutatingWebhookConfigurationParameters) *admissionregistrationv1.MutatingWebhookConfiguration {
+	clientConfig := admissionregistrationv1.WebhookClientConfig{
+		Service:  &parameters.ServiceReference,
+		CABundle: parameters.CACert.Bytes(),
+	}
+	if parameters.URL != "" {
+		clientConfig.Service = nil
+		clientConfig.URL = &parameters.URL
+	}
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "MutatingWebhookConfiguration",
+		},
 		ObjectMeta: v1.ObjectMeta{
 			Name: parameters.ConfigurationName,
 		},
 		Webhooks: []admissionregistrationv1.MutatingWebhook{
 			{
-				Name: parameters.WebhookName,
-				ClientConfig: admissionregistrationv1.WebhookClientConfig{
-					Service:  &parameters.ServiceReference,
-					CABundle: parameters.CACert.Bytes(),
-				},
+				Name:         parameters.WebhookName,
+				ClientConfig: clientConfig,
 				Rules: []admissionregistrationv1.RuleWithOperations{
 					{
-						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+						Operations: parameters.Operations,
 						Rule: admissionregistrationv1.Rule{
 							APIGroups:   []string{"apps", ""},
 							APIVersions: []string{"v1"},
@@ -46,9 +114,12 @@ func CreateMutateWebhookConfiguration(parameters MutatingWebhookConfigurationPar
 						},
 					},
 				},
-				// TimeoutSeconds:          &seconds30,
+				TimeoutSeconds:          &parameters.TimeoutSeconds,
 				FailurePolicy:           &parameters.FailurePolicy,
 				NamespaceSelector:       &parameters.WebhookNamespaceSelector,
+				ObjectSelector:          &parameters.WebhookObjectSelector,
+				ReinvocationPolicy:      &parameters.ReinvocationPolicy,
+				MatchPolicy:             &parameters.MatchPolicy,
 				AdmissionReviewVersions: []string{"v1", "v1beta1"},
 				SideEffects: func() *admissionregistrationv1.SideEffectClass {
 					se := admissionregistrationv1.SideEffectClassNone
@@ -57,11 +128,39 @@ func CreateMutateWebhookConfiguration(parameters MutatingWebhookConfigurationPar
 			},
 		},
 	}
+}
+
+// ApplyMutateWebhookConfiguration creates or updates the configuration with server-side apply,
+// so a restart replaces the caBundle left by the previous run instead of failing with AlreadyExists
+func ApplyMutateWebhookConfiguration(parameters MutatingWebhookConfigurationParameters) error {
+	cfg := BuildMutatingWebhookConfiguration(parameters)
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("json marshal mutatingwebhookconfiguration err: %v", err)
+		return err
+	}
 
 	mutateAdmissionClient := clientset.GetClientset().AdmissionregistrationV1().MutatingWebhookConfigurations()
-	_, err := mutateAdmissionClient.Create(context.TODO(), &cfg, v1.CreateOptions{})
+	_, err = mutateAdmissionClient.Patch(context.TODO(), cfg.GetName(), types.ApplyPatchType, data, v1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &forceApply,
+	})
 	if err != nil {
-		log.Printf("create mutatingwebhookconfiguration err: %v", err)
-		return
+		log.Printf("apply mutatingwebhookconfiguration err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func DeleteMutateWebhookConfiguration(name string, dryRun bool) error {
+	options := v1.DeleteOptions{}
+	if dryRun {
+		options.DryRun = []string{v1.DryRunAll}
+	}
+	mutateAdmissionClient := clientset.GetClientset().AdmissionregistrationV1().MutatingWebhookConfigurations()
+	if err := mutateAdmissionClient.Delete(context.TODO(), name, options); err != nil {
+		log.Printf("delete mutatingwebhookconfiguration err: %v", err)
+		return err
 	}
+	return nil
 }
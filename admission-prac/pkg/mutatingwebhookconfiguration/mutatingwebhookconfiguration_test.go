@@ -0,0 +1,91 @@
+package mutatingwebhookconfiguration
+
+import (
+	"reflect"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    admissionregistrationv1.FailurePolicyType
+		wantErr bool
+	}{
+		{value: "Fail", want: admissionregistrationv1.Fail},
+		{value: "Ignore", want: admissionregistrationv1.Ignore},
+		{value: "fail", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFailurePolicy(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseFailurePolicy(%q) = %q, %v, want %q, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseReinvocationPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    admissionregistrationv1.ReinvocationPolicyType
+		wantErr bool
+	}{
+		{value: "Never", want: admissionregistrationv1.NeverReinvocationPolicy},
+		{value: "IfNeeded", want: admissionregistrationv1.IfNeededReinvocationPolicy},
+		{value: "Always", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseReinvocationPolicy(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseReinvocationPolicy(%q) = %q, %v, want %q, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseMatchPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    admissionregistrationv1.MatchPolicyType
+		wantErr bool
+	}{
+		{value: "Exact", want: admissionregistrationv1.Exact},
+		{value: "Equivalent", want: admissionregistrationv1.Equivalent},
+		{value: "Fuzzy", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMatchPolicy(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMatchPolicy(%q) = %q, %v, want %q, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []admissionregistrationv1.OperationType
+		wantErr bool
+	}{
+		{value: "CREATE", want: []admissionregistrationv1.OperationType{admissionregistrationv1.Create}},
+		{value: "create, update", want: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update}},
+		{value: "*", want: []admissionregistrationv1.OperationType{admissionregistrationv1.OperationAll}},
+		{value: "CREATE,PATCH", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOperations(tt.value)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseOperations(%q) = %v, %v, want %v, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateTimeoutSeconds(t *testing.T) {
+	for timeoutSeconds, wantErr := range map[int32]bool{0: true, 1: false, 10: false, 30: false, 31: true} {
+		if err := ValidateTimeoutSeconds(timeoutSeconds); (err != nil) != wantErr {
+			t.Errorf("ValidateTimeoutSeconds(%d) error = %v, wantErr %v", timeoutSeconds, err, wantErr)
+		}
+	}
+}
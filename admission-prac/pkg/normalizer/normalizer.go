@@ -0,0 +1,205 @@
+package normalizer
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	informersv1 "k8s.io/client-go/informers/core/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	// FieldManager owns only the capacity label, labels of the provisioners stay theirs
+	FieldManager = "admission-prac-normalizer"
+	// without force, a capacity label owned by someone else is left alone instead of taken over
+	forceApply = false
+)
+
+type NormalizerParameters struct {
+	Rules []config.CapacityRule
+	// NodeInformer is the shared node informer of the webhook, it is started and synced by its factory
+	NodeInformer informersv1.NodeInformer
+}
+
+type rule struct {
+	config.CapacityRule
+	regex         *regexp.Regexp
+	instanceTypes map[string]bool
+}
+
+type normalizer struct {
+	rules []rule
+	queue workqueue.RateLimitingInterface
+	nodes listersv1.NodeLister
+}
+
+type nodeEventHandler struct {
+	queue workqueue.RateLimitingInterface
+}
+
+func (h *nodeEventHandler) OnAdd(obj interface{}) {
+	if node, ok := obj.(*corev1.Node); ok {
+		h.queue.Add(node.Name)
+	}
+}
+
+func (h *nodeEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	// the shared informer resyncs often, only nodes that changed are checked again
+	oldNode, ok := oldObj.(*corev1.Node)
+	newNode, newOk := newObj.(*corev1.Node)
+	if ok && newOk && oldNode.ResourceVersion == newNode.ResourceVersion {
+		return
+	}
+	h.OnAdd(newObj)
+}
+
+func (h *nodeEventHandler) OnDelete(obj interface{}) {
+}
+
+// Run keeps the capacity label of every node in line with the rules until stopCh is closed,
+// so the node affinity set by the webhook matches nodes of any provisioner
+func Run(parameters NormalizerParameters, stopCh <-chan struct{}) {
+	logrus.Println("starting node capacity label normalizer")
+	n := &normalizer{
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "normalizer"),
+	}
+	defer n.queue.ShutDown()
+	n.rules = compileRules(parameters.Rules)
+
+	nodeInformer := parameters.NodeInformer
+	nodeInformer.Informer().AddEventHandler(&nodeEventHandler{queue: n.queue})
+	n.nodes = nodeInformer.Lister()
+	if !cache.WaitForCacheSync(stopCh, nodeInformer.Informer().HasSynced) {
+		logrus.Error("failed to sync normalizer cache")
+		return
+	}
+
+	go wait.Until(n.runWorker, time.Second, stopCh)
+	<-stopCh
+	logrus.Debug("normalizer stopped")
+}
+
+func compileRules(capacityRules []config.CapacityRule) []rule {
+	rules := []rule{}
+	for _, capacityRule := range capacityRules {
+		r := rule{
+			CapacityRule:  capacityRule,
+			instanceTypes: make(map[string]bool),
+		}
+		if capacityRule.Label != "" {
+			// validated with the config
+			r.regex = regexp.MustCompile(capacityRule.Regex)
+		}
+		for _, instanceType := range capacityRule.InstanceTypes {
+			r.instanceTypes[instanceType] = true
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func (n *normalizer) runWorker() {
+	for n.processNextItem() {
+	}
+}
+
+func (n *normalizer) processNextItem() bool {
+	key, quit := n.queue.Get()
+	if quit {
+		return false
+	}
+	defer n.queue.Done(key)
+
+	if err := n.reconcile(key.(string)); err != nil {
+		logrus.WithField("node", key).WithError(err).Error("normalize node capacity label err, retrying")
+		n.queue.AddRateLimited(key)
+		return true
+	}
+	n.queue.Forget(key)
+	return true
+}
+
+func (n *normalizer) reconcile(nodeName string) error {
+	node, err := n.nodes.Get(nodeName)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	placement := config.GetPlacement()
+	capacity, ok := n.capacityOf(node)
+	if !ok {
+		logrus.WithField("node", nodeName).Debug("no capacity rule matches node")
+		return nil
+	}
+	value := placement.SpotValue
+	if capacity == config.CapacityOnDemand {
+		value = placement.OnDemandValue
+	}
+	if node.Labels[placement.CapacityLabelKey] == value {
+		return nil
+	}
+
+	// a map instead of a corev1.Node, the zero values of a marshalled node would be applied as well
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Node",
+		"metadata": map[string]interface{}{
+			"name": nodeName,
+			"labels": map[string]string{
+				placement.CapacityLabelKey: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.GetClientset().CoreV1().Nodes().Patch(context.TODO(), nodeName, types.ApplyPatchType, data, v1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &forceApply,
+	})
+	if apierrors.IsConflict(err) {
+		logrus.WithField("node", nodeName).Warnf("capacity label %s is owned by another manager, left at %q instead of %q",
+			placement.CapacityLabelKey, node.Labels[placement.CapacityLabelKey], value)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"node":  nodeName,
+		"label": placement.CapacityLabelKey,
+		"value": value,
+	}).Println("normalized node capacity label")
+	return nil
+}
+
+func (n *normalizer) capacityOf(node *corev1.Node) (string, bool) {
+	instanceType := node.Labels[corev1.LabelInstanceTypeStable]
+	for _, r := range n.rules {
+		if r.regex != nil {
+			if value, ok := node.Labels[r.Label]; ok && r.regex.MatchString(value) {
+				return r.Capacity, true
+			}
+			continue
+		}
+		if instanceType != "" && r.instanceTypes[instanceType] {
+			return r.Capacity, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,68 @@
+package normalizer
+
+import (
+	"testing"
+
+	"practices/admission-prac/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCapacityOf(t *testing.T) {
+	n := &normalizer{
+		rules: compileRules([]config.CapacityRule{
+			{Label: "karpenter.sh/capacity-type", Regex: "^spot$", Capacity: config.CapacitySpot},
+			{Label: "eks.amazonaws.com/capacityType", Regex: "(?i)^on_demand$", Capacity: config.CapacityOnDemand},
+			{InstanceTypes: []string{"m5.large", "m5.xlarge"}, Capacity: config.CapacityOnDemand},
+			{Label: "eks.amazonaws.com/capacityType", Regex: "SPOT", Capacity: config.CapacitySpot},
+		}),
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+		wantOk bool
+	}{
+		{
+			name:   "label regex",
+			labels: map[string]string{"karpenter.sh/capacity-type": "spot"},
+			want:   config.CapacitySpot,
+			wantOk: true,
+		},
+		{
+			name:   "label regex not matching goes on to the next rules",
+			labels: map[string]string{"karpenter.sh/capacity-type": "on-demand", "eks.amazonaws.com/capacityType": "ON_DEMAND"},
+			want:   config.CapacityOnDemand,
+			wantOk: true,
+		},
+		{
+			name:   "instance type",
+			labels: map[string]string{corev1.LabelInstanceTypeStable: "m5.xlarge"},
+			want:   config.CapacityOnDemand,
+			wantOk: true,
+		},
+		{
+			name:   "first matching rule wins",
+			labels: map[string]string{corev1.LabelInstanceTypeStable: "m5.large", "eks.amazonaws.com/capacityType": "SPOT"},
+			want:   config.CapacityOnDemand,
+			wantOk: true,
+		},
+		{
+			name:   "unknown instance type",
+			labels: map[string]string{corev1.LabelInstanceTypeStable: "c5.large"},
+		},
+		{
+			name: "no labels",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node", Labels: tt.labels}}
+			got, ok := n.capacityOf(node)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("capacityOf() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package priorityclass
+
+import (
+	"context"
+
+	"practices/admission-prac/pkg/clientset"
+
+	"github.com/sirupsen/logrus"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type PriorityClassParameters struct {
+	Name        string
+	Value       int32
+	Description string
+}
+
+func BuildPriorityClass(parameters PriorityClassParameters) *schedulingv1.PriorityClass {
+	return &schedulingv1.PriorityClass{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "scheduling.k8s.io/v1",
+			Kind:       "PriorityClass",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name: parameters.Name,
+		},
+		Value:       parameters.Value,
+		Description: parameters.Description,
+	}
+}
+
+// CreatePriorityClass creates the class when it does not exist, an existing class is left as it is
+// as its value may have been tuned by the cluster admin
+func CreatePriorityClass(parameters PriorityClassParameters) error {
+	priorityClass := BuildPriorityClass(parameters)
+	_, err := clientset.GetClientset().SchedulingV1().PriorityClasses().Create(context.TODO(), priorityClass, v1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		logrus.WithField("priorityClass", parameters.Name).Debug("priority class exists")
+		return nil
+	}
+	if err != nil {
+		logrus.Errorf("create priority class %s err: %v", parameters.Name, err)
+		return err
+	}
+	logrus.WithField("priorityClass", parameters.Name).Println("priority class created")
+	return nil
+}
@@ -0,0 +1,63 @@
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"practices/admission-prac/pkg/clientset"
+
+	"github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckPermissions asks the apiserver with SelfSubjectAccessReview whether every permission is granted,
+// and returns the missing ones in a readable form
+func CheckPermissions(permissions []Permission) ([]string, error) {
+	missing := []string{}
+	reviewClient := clientset.GetClientset().AuthorizationV1().SelfSubjectAccessReviews()
+	for _, permission := range permissions {
+		// a subresource like pods/eviction is asked for separately
+		resource, subresource, _ := strings.Cut(permission.Resource, "/")
+		for _, verb := range permission.Verbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Group:       permission.Group,
+						Resource:    resource,
+						Subresource: subresource,
+						Verb:        verb,
+						Namespace:   permission.Namespace,
+					},
+				},
+			}
+			// create can not be granted for a single name, list and watch are asked for with the field selector
+			// on metadata.name the informers use, which resourceNames allow
+			if verb != "create" {
+				review.Spec.ResourceAttributes.Name = permission.Name
+			}
+			result, err := reviewClient.Create(context.TODO(), review, v1.CreateOptions{})
+			if err != nil {
+				logrus.Errorf("create selfsubjectaccessreview err: %v", err)
+				return missing, err
+			}
+			if !result.Status.Allowed {
+				missing = append(missing, describe(permission, verb))
+			}
+		}
+	}
+	return missing, nil
+}
+
+func describe(permission Permission, verb string) string {
+	resource := permission.Resource
+	if permission.Group != "" {
+		resource = permission.Resource + "." + permission.Group
+	}
+	scope := "cluster wide"
+	if permission.Namespace != "" {
+		scope = "in namespace " + permission.Namespace
+	}
+	return fmt.Sprintf("%s %s %s, needed by %s", verb, resource, scope, permission.Reason)
+}
@@ -0,0 +1,331 @@
+package rbac
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type RBACParameters struct {
+	ClusterRoleName    string
+	ServiceAccountName string
+	Namespace          string
+	// Permissions names the objects the rules are narrowed to, the feature switches are ignored
+	Permissions PermissionParameters
+}
+
+// Permission is one resource the binary touches, a Namespace puts it in the Role and a Name in resourceNames
+type Permission struct {
+	Group     string
+	Resource  string
+	Verbs     []string
+	Namespace string
+	Name      string
+	// Reason tells which part of the binary needs the permission
+	Reason string
+}
+
+type PermissionParameters struct {
+	SelfRegister                       bool
+	ServiceName                        string
+	ServiceNamespace                   string
+	MutatingWebhookConfigurationName   string
+	ValidatingWebhookConfigurationName string
+	Rebalance                          bool
+	Interruption                       bool
+	Fallback                           bool
+	Normalizer                         bool
+	PriorityClasses                    bool
+	OnDemandPDB                        bool
+	Budget                             bool
+	BudgetStatusConfigMap              string
+	CreatePriorityClasses              bool
+	DeploymentName                     string
+	DeploymentNamespace                string
+}
+
+// RequiredPermissions lists what the binary needs with the given parameters
+func RequiredPermissions(parameters PermissionParameters) []Permission {
+	permissions := []Permission{
+		{
+			Resource: "pods",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "pod informer",
+		},
+		{
+			Group:    "apps",
+			Resource: "replicasets",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "replicaset informer",
+		},
+		{
+			Group:    "apps",
+			Resource: "deployments",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "deployment informer",
+		},
+		{
+			Resource: "namespaces",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "namespace informer",
+		},
+		{
+			Group:    "policy",
+			Resource: "poddisruptionbudgets",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "poddisruptionbudget informer",
+		},
+		{
+			Resource: "nodes",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "node informer",
+		},
+		{
+			Resource: "events",
+			Verbs:    []string{"create", "patch"},
+			Reason:   "event recorder",
+		},
+		{
+			Group:     "apps",
+			Resource:  "deployments",
+			Verbs:     []string{"get"},
+			Namespace: parameters.DeploymentNamespace,
+			Name:      parameters.DeploymentName,
+			Reason:    "cert monitor events",
+		},
+	}
+	if parameters.Rebalance || parameters.Interruption || parameters.Fallback {
+		permissions = append(permissions, Permission{
+			Resource: "pods/eviction",
+			Verbs:    []string{"create"},
+			Reason:   "rebalancer, interrupted nodes and spot fallback",
+		})
+	}
+	if parameters.Fallback {
+		permissions = append(permissions,
+			Permission{
+				Resource: "pods",
+				Verbs:    []string{"delete"},
+				Reason:   "spot fallback recreating unschedulable pods",
+			},
+			Permission{
+				Group:    "apps",
+				Resource: "deployments",
+				Verbs:    []string{"patch"},
+				Reason:   "spot fallback marking deployments degraded",
+			},
+		)
+	}
+	if parameters.Normalizer {
+		permissions = append(permissions, Permission{
+			Resource: "nodes",
+			Verbs:    []string{"patch"},
+			Reason:   "node capacity label normalizer",
+		})
+	}
+	if parameters.OnDemandPDB {
+		permissions = append(permissions, Permission{
+			Group:    "policy",
+			Resource: "poddisruptionbudgets",
+			Verbs:    []string{"create", "patch", "delete"},
+			Reason:   "on-demand poddisruptionbudgets",
+		})
+	}
+	if parameters.Budget {
+		permissions = append(permissions,
+			Permission{
+				Resource:  "configmaps",
+				Verbs:     []string{"create"},
+				Namespace: parameters.ServiceNamespace,
+				Reason:    "on-demand budget status",
+			},
+			Permission{
+				Resource:  "configmaps",
+				Verbs:     []string{"patch"},
+				Namespace: parameters.ServiceNamespace,
+				Name:      parameters.BudgetStatusConfigMap,
+				Reason:    "on-demand budget status",
+			},
+		)
+	}
+	if parameters.PriorityClasses {
+		permissions = append(permissions, Permission{
+			Group:    "scheduling.k8s.io",
+			Resource: "priorityclasses",
+			Verbs:    []string{"list", "watch"},
+			Reason:   "priority class informer",
+		})
+	}
+	if parameters.CreatePriorityClasses {
+		permissions = append(permissions, Permission{
+			Group:    "scheduling.k8s.io",
+			Resource: "priorityclasses",
+			Verbs:    []string{"create"},
+			Reason:   "default priority classes",
+		})
+	}
+	if parameters.SelfRegister {
+		// create can't be narrowed by name, everything else only touches our own objects
+		permissions = append(permissions,
+			Permission{
+				Resource:  "services",
+				Verbs:     []string{"create"},
+				Namespace: parameters.ServiceNamespace,
+				Reason:    "self register",
+			},
+			Permission{
+				Resource:  "services",
+				Verbs:     []string{"get", "list", "watch", "update", "patch", "delete"},
+				Namespace: parameters.ServiceNamespace,
+				Name:      parameters.ServiceName,
+				Reason:    "self register",
+			},
+			Permission{
+				Group:    "admissionregistration.k8s.io",
+				Resource: "mutatingwebhookconfigurations",
+				Verbs:    []string{"create"},
+				Reason:   "self register",
+			},
+			Permission{
+				Group:    "admissionregistration.k8s.io",
+				Resource: "mutatingwebhookconfigurations",
+				Verbs:    []string{"get", "list", "watch", "update", "patch", "delete"},
+				Name:     parameters.MutatingWebhookConfigurationName,
+				Reason:   "self register",
+			},
+			Permission{
+				Group:    "admissionregistration.k8s.io",
+				Resource: "validatingwebhookconfigurations",
+				Verbs:    []string{"create"},
+				Reason:   "self register",
+			},
+			Permission{
+				Group:    "admissionregistration.k8s.io",
+				Resource: "validatingwebhookconfigurations",
+				Verbs:    []string{"get", "list", "watch", "update", "patch", "delete"},
+				Name:     parameters.ValidatingWebhookConfigurationName,
+				Reason:   "self register",
+			},
+		)
+	}
+	return permissions
+}
+
+// allPermissions is what the binary may need with any flags, narrowed to the objects named in parameters
+func allPermissions(parameters PermissionParameters) []Permission {
+	parameters.SelfRegister = true
+	parameters.Rebalance = true
+	parameters.Interruption = true
+	parameters.Fallback = true
+	parameters.Normalizer = true
+	parameters.PriorityClasses = true
+	parameters.CreatePriorityClasses = true
+	parameters.OnDemandPDB = true
+	parameters.Budget = true
+	return RequiredPermissions(parameters)
+}
+
+// rules turns the permissions in namespace into policy rules, "" picks the cluster wide ones
+func rules(parameters PermissionParameters, namespace string) []rbacv1.PolicyRule {
+	rules := []rbacv1.PolicyRule{}
+	for _, permission := range allPermissions(parameters) {
+		if (permission.Namespace == "") != (namespace == "") {
+			continue
+		}
+		rule := rbacv1.PolicyRule{
+			APIGroups: []string{permission.Group},
+			Resources: []string{permission.Resource},
+			Verbs:     permission.Verbs,
+		}
+		if permission.Name != "" {
+			rule.ResourceNames = []string{permission.Name}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ClusterRoleRules grants the cluster wide permissions the binary may need with any flags
+func ClusterRoleRules(parameters PermissionParameters) []rbacv1.PolicyRule {
+	return rules(parameters, "")
+}
+
+// RoleRules grants the permissions on objects in the webhook's own namespace
+func RoleRules(parameters PermissionParameters) []rbacv1.PolicyRule {
+	return rules(parameters, parameters.ServiceNamespace)
+}
+
+func BuildClusterRole(parameters RBACParameters) *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name: parameters.ClusterRoleName,
+		},
+		Rules: ClusterRoleRules(parameters.Permissions),
+	}
+}
+
+func BuildClusterRoleBinding(parameters RBACParameters) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRoleBinding",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name: parameters.ClusterRoleName + "-binding",
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     parameters.ClusterRoleName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      parameters.ServiceAccountName,
+				Namespace: parameters.Namespace,
+			},
+		},
+	}
+}
+
+func BuildRole(parameters RBACParameters) *rbacv1.Role {
+	return &rbacv1.Role{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "Role",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.ClusterRoleName,
+			Namespace: parameters.Namespace,
+		},
+		Rules: RoleRules(parameters.Permissions),
+	}
+}
+
+func BuildRoleBinding(parameters RBACParameters) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "RoleBinding",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.ClusterRoleName + "-binding",
+			Namespace: parameters.Namespace,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     parameters.ClusterRoleName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      parameters.ServiceAccountName,
+				Namespace: parameters.Namespace,
+			},
+		},
+	}
+}
@@ -0,0 +1,145 @@
+package rbac
+
+import (
+	"os"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultPermissionParameters are the names the checked-in yaml files are written for
+var defaultPermissionParameters = PermissionParameters{
+	ServiceName:                        "test-mutate-webhook",
+	ServiceNamespace:                   "test",
+	MutatingWebhookConfigurationName:   "test-admission-mutate",
+	ValidatingWebhookConfigurationName: "test-admission-validate",
+	BudgetStatusConfigMap:              "admission-prac-budget",
+	DeploymentName:                     "test-mutate-webhook",
+	DeploymentNamespace:                "test",
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// granted tells whether the rules allow the verb like the apiserver would for CheckPermissions,
+// a rule with resourceNames only allows requests for one of those names
+func granted(rules []rbacv1.PolicyRule, permission Permission, verb string) bool {
+	name := permission.Name
+	if verb == "create" {
+		name = ""
+	}
+	for _, rule := range rules {
+		if !contains(rule.APIGroups, permission.Group) || !contains(rule.Resources, permission.Resource) || !contains(rule.Verbs, verb) {
+			continue
+		}
+		if len(rule.ResourceNames) == 0 || (name != "" && contains(rule.ResourceNames, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkGranted(t *testing.T, clusterRules, roleRules []rbacv1.PolicyRule) {
+	t.Helper()
+	for _, permission := range allPermissions(defaultPermissionParameters) {
+		rules := clusterRules
+		if permission.Namespace != "" {
+			rules = roleRules
+		}
+		for _, verb := range permission.Verbs {
+			if !granted(rules, permission, verb) {
+				t.Errorf("%s not granted", describe(permission, verb))
+			}
+		}
+	}
+}
+
+func TestRenderedRulesGrantRequiredPermissions(t *testing.T) {
+	checkGranted(t, ClusterRoleRules(defaultPermissionParameters), RoleRules(defaultPermissionParameters))
+}
+
+func TestRenderedRulesAreNarrowedByName(t *testing.T) {
+	for _, rule := range ClusterRoleRules(defaultPermissionParameters) {
+		if contains(rule.Resources, "mutatingwebhookconfigurations") && contains(rule.Verbs, "delete") && len(rule.ResourceNames) == 0 {
+			t.Errorf("delete on every mutatingwebhookconfiguration granted: %+v", rule)
+		}
+		if contains(rule.Resources, "services") || contains(rule.Resources, "configmaps") {
+			t.Errorf("namespaced resource in the clusterrole: %+v", rule)
+		}
+	}
+	for _, rule := range RoleRules(defaultPermissionParameters) {
+		if contains(rule.Resources, "services") && contains(rule.Verbs, "delete") && len(rule.ResourceNames) == 0 {
+			t.Errorf("delete on every service granted: %+v", rule)
+		}
+	}
+}
+
+func loadRules(t *testing.T, path string) []rbacv1.PolicyRule {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	// a role and a clusterrole have the same rules
+	role := rbacv1.Role{}
+	if err := yaml.UnmarshalStrict(data, &role); err != nil {
+		t.Fatalf("parse %s: %v", path, err)
+	}
+	return role.Rules
+}
+
+func TestCheckedInRulesGrantRequiredPermissions(t *testing.T) {
+	checkGranted(t, loadRules(t, "../../clusterrole.yaml"), loadRules(t, "../../role.yaml"))
+}
+
+func TestRequiredPermissions(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters PermissionParameters
+		want       map[string]bool
+	}{
+		{
+			name:       "informers only",
+			parameters: PermissionParameters{},
+			want:       map[string]bool{"pods/eviction": false, "services": false, "configmaps": false, "priorityclasses": false},
+		},
+		{
+			name:       "self register",
+			parameters: PermissionParameters{SelfRegister: true, ServiceName: "svc", ServiceNamespace: "ns"},
+			want:       map[string]bool{"services": true, "mutatingwebhookconfigurations": true, "validatingwebhookconfigurations": true},
+		},
+		{
+			name:       "interruptions evict",
+			parameters: PermissionParameters{Interruption: true},
+			want:       map[string]bool{"pods/eviction": true},
+		},
+		{
+			name:       "budget status",
+			parameters: PermissionParameters{Budget: true, ServiceNamespace: "ns", BudgetStatusConfigMap: "cm"},
+			want:       map[string]bool{"configmaps": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := map[string]bool{}
+			for _, permission := range RequiredPermissions(tt.parameters) {
+				found[permission.Resource] = true
+				if permission.Name != "" && contains(permission.Verbs, "create") {
+					t.Errorf("create on %s can not be narrowed to %s", permission.Resource, permission.Name)
+				}
+			}
+			for resource, want := range tt.want {
+				if found[resource] != want {
+					t.Errorf("permission on %s: got %v, want %v", resource, found[resource], want)
+				}
+			}
+		})
+	}
+}
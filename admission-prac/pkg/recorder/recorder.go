@@ -0,0 +1,42 @@
+package recorder
+
+import (
+	"practices/admission-prac/pkg/clientset"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var (
+	component = "admission-prac"
+	recorder  record.EventRecorder
+	// a scale up admits many pods of one workload at once, similar events on an object are aggregated
+	// after MaxEvents and further ones are limited to a burst and then one a minute
+	correlatorOptions = record.CorrelatorOptions{
+		BurstSize:            25,
+		QPS:                  1.0 / 60,
+		MaxEvents:            10,
+		MaxIntervalInSeconds: 600,
+	}
+)
+
+func InitRecorder() {
+	logrus.Println("initing event recorder")
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(correlatorOptions)
+	broadcaster.StartLogging(logrus.Debugf)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.GetClientset().CoreV1().Events(""),
+	})
+	recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+}
+
+func GetRecorder() record.EventRecorder {
+	if recorder == nil {
+		// events are best effort, drop them if the recorder is not inited
+		return &record.FakeRecorder{}
+	}
+	return recorder
+}
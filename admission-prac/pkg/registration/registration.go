@@ -0,0 +1,202 @@
+package registration
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"practices/admission-prac/pkg/clientset"
+	"practices/admission-prac/pkg/mutatingwebhookconfiguration"
+	"practices/admission-prac/pkg/service"
+	"practices/admission-prac/pkg/validatingwebhookconfiguration"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	serviceKey                        = "service"
+	mutatingWebhookConfigurationKey   = "mutatingwebhookconfiguration"
+	validatingWebhookConfigurationKey = "validatingwebhookconfiguration"
+)
+
+var (
+	// resync is a safety net, edits and deletions are caught by the watches right away
+	resyncPeriod = 10 * time.Minute
+)
+
+type RegistrationParameters struct {
+	Service                        service.ServiceParameters
+	MutatingWebhookConfiguration   mutatingwebhookconfiguration.MutatingWebhookConfigurationParameters
+	ValidatingWebhookConfiguration validatingwebhookconfiguration.ValidatingWebhookConfigurationParameters
+	// NoService leaves the service alone, the webhook is reached through its url
+	NoService bool
+	// Registered is closed once the mutatingwebhookconfiguration was applied the first time, may be nil
+	Registered chan struct{}
+}
+
+type reconciler struct {
+	parameters RegistrationParameters
+	queue      workqueue.RateLimitingInterface
+	registered sync.Once
+}
+
+type registrationEventHandler struct {
+	key   string
+	queue workqueue.RateLimitingInterface
+}
+
+func (h *registrationEventHandler) OnAdd(obj interface{}) {
+	h.queue.Add(h.key)
+}
+
+func (h *registrationEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.queue.Add(h.key)
+}
+
+func (h *registrationEventHandler) OnDelete(obj interface{}) {
+	h.queue.Add(h.key)
+}
+
+// Run applies the desired service and webhook configurations, then watches them
+// and applies them again whenever someone edits or deletes them, until stopCh is closed
+func Run(parameters RegistrationParameters, stopCh <-chan struct{}) {
+	logrus.Println("self registering")
+	r := &reconciler{
+		parameters: parameters,
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "registration"),
+	}
+	defer r.queue.ShutDown()
+
+	cs := clientset.GetClientset()
+	cacheSyncs := []cache.InformerSynced{}
+	if !parameters.NoService {
+		serviceInformerFactory := informers.NewSharedInformerFactoryWithOptions(cs, resyncPeriod,
+			informers.WithNamespace(parameters.Service.Namespace),
+			informers.WithTweakListOptions(func(options *v1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", parameters.Service.Name).String()
+			}),
+		)
+		serviceInformer := serviceInformerFactory.Core().V1().Services().Informer()
+		serviceInformer.AddEventHandler(&registrationEventHandler{key: serviceKey, queue: r.queue})
+		serviceInformerFactory.Start(stopCh)
+		cacheSyncs = append(cacheSyncs, serviceInformer.HasSynced)
+		// apply once without waiting for the watches, nothing is there on the first install
+		r.queue.Add(serviceKey)
+	}
+
+	webhookInformerFactory := informers.NewSharedInformerFactoryWithOptions(cs, resyncPeriod,
+		informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", parameters.MutatingWebhookConfiguration.ConfigurationName).String()
+		}),
+	)
+	webhookInformer := webhookInformerFactory.Admissionregistration().V1().MutatingWebhookConfigurations().Informer()
+	webhookInformer.AddEventHandler(&registrationEventHandler{key: mutatingWebhookConfigurationKey, queue: r.queue})
+
+	r.queue.Add(mutatingWebhookConfigurationKey)
+	webhookInformerFactory.Start(stopCh)
+	cacheSyncs = append(cacheSyncs, webhookInformer.HasSynced)
+
+	validatingWebhookInformerFactory := informers.NewSharedInformerFactoryWithOptions(cs, resyncPeriod,
+		informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", parameters.ValidatingWebhookConfiguration.ConfigurationName).String()
+		}),
+	)
+	validatingWebhookInformer := validatingWebhookInformerFactory.Admissionregistration().V1().ValidatingWebhookConfigurations().Informer()
+	validatingWebhookInformer.AddEventHandler(&registrationEventHandler{key: validatingWebhookConfigurationKey, queue: r.queue})
+
+	r.queue.Add(validatingWebhookConfigurationKey)
+	validatingWebhookInformerFactory.Start(stopCh)
+	cacheSyncs = append(cacheSyncs, validatingWebhookInformer.HasSynced)
+
+	if !cache.WaitForCacheSync(stopCh, cacheSyncs...) {
+		logrus.Error("failed to sync registration cache")
+		return
+	}
+
+	go wait.Until(r.runWorker, time.Second, stopCh)
+	<-stopCh
+	logrus.Debug("registration reconciler stopped")
+}
+
+func (r *reconciler) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *reconciler) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	if err := r.reconcile(key.(string)); err != nil {
+		logrus.WithField("key", key).WithError(err).Error("reconcile registration err, retrying")
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+func (r *reconciler) reconcile(key string) error {
+	logrus.WithField("key", key).Debug("reconciling registration")
+	switch key {
+	case serviceKey:
+		return service.ApplyService(r.parameters.Service)
+	case mutatingWebhookConfigurationKey:
+		if err := mutatingwebhookconfiguration.ApplyMutateWebhookConfiguration(r.parameters.MutatingWebhookConfiguration); err != nil {
+			return err
+		}
+		if r.parameters.Registered != nil {
+			r.registered.Do(func() { close(r.parameters.Registered) })
+		}
+		return nil
+	case validatingWebhookConfigurationKey:
+		return validatingwebhookconfiguration.ApplyValidatingWebhookConfiguration(r.parameters.ValidatingWebhookConfiguration)
+	}
+	return nil
+}
+
+// Deregister deletes the webhook configurations and the service applied by Run and returns what was removed,
+// with dryRun nothing is deleted and the returned list is what would be removed.
+// Run must be stopped first, or it will put them back
+func Deregister(parameters RegistrationParameters, dryRun bool) ([]string, error) {
+	removed := []string{}
+	// the webhooks go first, so the apiserver stops calling a service that is about to disappear
+	configurationName := parameters.MutatingWebhookConfiguration.ConfigurationName
+	err := mutatingwebhookconfiguration.DeleteMutateWebhookConfiguration(configurationName, dryRun)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return removed, err
+	}
+	if err == nil {
+		removed = append(removed, fmt.Sprintf("mutatingwebhookconfiguration/%s", configurationName))
+	}
+	validatingConfigurationName := parameters.ValidatingWebhookConfiguration.ConfigurationName
+	err = validatingwebhookconfiguration.DeleteValidatingWebhookConfiguration(validatingConfigurationName, dryRun)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return removed, err
+	}
+	if err == nil {
+		removed = append(removed, fmt.Sprintf("validatingwebhookconfiguration/%s", validatingConfigurationName))
+	}
+
+	if parameters.NoService {
+		return removed, nil
+	}
+	err = service.DeleteService(parameters.Service.Name, parameters.Service.Namespace, dryRun)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return removed, err
+	}
+	if err == nil {
+		removed = append(removed, fmt.Sprintf("service/%s/%s", parameters.Service.Namespace, parameters.Service.Name))
+	}
+	return removed, nil
+}
@@ -0,0 +1,268 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"practices/admission-prac/pkg/mutatingwebhookconfiguration"
+	"practices/admission-prac/pkg/rbac"
+	"practices/admission-prac/pkg/service"
+	"practices/admission-prac/pkg/validatingwebhookconfiguration"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	FormatYAML      = "yaml"
+	FormatKustomize = "kustomize"
+	// ConfigFileName is the key of the config in the configmap and its file name in ConfigDir
+	ConfigFileName = "config.yaml"
+)
+
+var (
+	replicas int32 = 1
+)
+
+type DeploymentParameters struct {
+	Name          string
+	Namespace     string
+	Labels        map[string]string
+	Image         string
+	Args          []string
+	ContainerPort int32
+	PortName      string
+	CertsDir      string
+	// SecretName is the tls secret holding the generated cert, mounted into CertsDir
+	SecretName string
+	// ConfigMapName holds the effective config, mounted into ConfigDir so edits are picked up live
+	ConfigMapName string
+	ConfigDir     string
+}
+
+type RenderParameters struct {
+	Service                        service.ServiceParameters
+	MutatingWebhookConfiguration   mutatingwebhookconfiguration.MutatingWebhookConfigurationParameters
+	ValidatingWebhookConfiguration validatingwebhookconfiguration.ValidatingWebhookConfigurationParameters
+	RBAC                           rbac.RBACParameters
+	Deployment                     DeploymentParameters
+	TLSCert                        *bytes.Buffer
+	TLSKey                         *bytes.Buffer
+	// Config is the effective config file the deployment runs with
+	Config []byte
+}
+
+// BuildObjects returns everything needed to run the webhook, in the order they should be applied
+func BuildObjects(parameters RenderParameters) []runtime.Object {
+	return []runtime.Object{
+		buildServiceAccount(parameters),
+		rbac.BuildClusterRole(parameters.RBAC),
+		rbac.BuildClusterRoleBinding(parameters.RBAC),
+		rbac.BuildRole(parameters.RBAC),
+		rbac.BuildRoleBinding(parameters.RBAC),
+		buildSecret(parameters),
+		buildConfigMap(parameters),
+		service.BuildService(parameters.Service),
+		buildDeployment(parameters),
+		mutatingwebhookconfiguration.BuildMutatingWebhookConfiguration(parameters.MutatingWebhookConfiguration),
+		validatingwebhookconfiguration.BuildValidatingWebhookConfiguration(parameters.ValidatingWebhookConfiguration),
+	}
+}
+
+func buildServiceAccount(parameters RenderParameters) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.RBAC.ServiceAccountName,
+			Namespace: parameters.RBAC.Namespace,
+		},
+	}
+}
+
+func buildSecret(parameters RenderParameters) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.Deployment.SecretName,
+			Namespace: parameters.Deployment.Namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       parameters.TLSCert.Bytes(),
+			corev1.TLSPrivateKeyKey: parameters.TLSKey.Bytes(),
+		},
+	}
+}
+
+func buildConfigMap(parameters RenderParameters) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      parameters.Deployment.ConfigMapName,
+			Namespace: parameters.Deployment.Namespace,
+		},
+		Data: map[string]string{
+			ConfigFileName: string(parameters.Config),
+		},
+	}
+}
+
+func buildDeployment(parameters RenderParameters) *appsv1.Deployment {
+	deploymentParameters := parameters.Deployment
+	return &appsv1.Deployment{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      deploymentParameters.Name,
+			Namespace: deploymentParameters.Namespace,
+			Labels:    deploymentParameters.Labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
+			Selector: &v1.LabelSelector{
+				MatchLabels: deploymentParameters.Labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels: deploymentParameters.Labels,
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: parameters.RBAC.ServiceAccountName,
+					Containers: []corev1.Container{
+						{
+							Name:            "server",
+							Args:            deploymentParameters.Args,
+							Image:           deploymentParameters.Image,
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: deploymentParameters.ContainerPort,
+									Name:          deploymentParameters.PortName,
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									HTTPGet: &corev1.HTTPGetAction{
+										Path:   "/readyz",
+										Port:   intstr.FromString(deploymentParameters.PortName),
+										Scheme: corev1.URISchemeHTTPS,
+									},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "certs",
+									MountPath: deploymentParameters.CertsDir,
+									ReadOnly:  true,
+								},
+								{
+									Name:      "config",
+									MountPath: deploymentParameters.ConfigDir,
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "certs",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: deploymentParameters.SecretName,
+								},
+							},
+						},
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: deploymentParameters.ConfigMapName,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// WriteYAML writes all objects to w as one multi-document yaml
+func WriteYAML(w io.Writer, objects []runtime.Object) error {
+	for i, object := range objects {
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			logrus.Errorf("yaml marshal object err: %v", err)
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteKustomize writes one file per object and a kustomization.yaml listing them into dir
+func WriteKustomize(dir string, objects []runtime.Object) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.WithField("dir", dir).WithError(err).Error("failed to create kustomize dir")
+		return err
+	}
+	kustomization := bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n")
+	for _, object := range objects {
+		fileName, err := fileNameOf(object)
+		if err != nil {
+			return err
+		}
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			logrus.Errorf("yaml marshal object err: %v", err)
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, fileName), data, 0644); err != nil {
+			logrus.WithField("file", fileName).WithError(err).Error("failed to write manifest")
+			return err
+		}
+		fmt.Fprintf(kustomization, "- %s\n", fileName)
+	}
+	return os.WriteFile(filepath.Join(dir, "kustomization.yaml"), kustomization.Bytes(), 0644)
+}
+
+func fileNameOf(object runtime.Object) (string, error) {
+	accessor, ok := object.(v1.Object)
+	if !ok {
+		return "", fmt.Errorf("object %T has no metadata", object)
+	}
+	kind := strings.ToLower(object.GetObjectKind().GroupVersionKind().Kind)
+	return fmt.Sprintf("%s-%s.yaml", kind, accessor.GetName()), nil
+}
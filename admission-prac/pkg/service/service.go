@@ -2,14 +2,21 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"practices/admission-prac/pkg/clientset"
 )
 
+var (
+	FieldManager = "admission-prac"
+	forceApply   = true
+)
+
 type ServiceParameters struct {
 	Name      string
 	Namespace string
@@ -17,8 +24,12 @@ type ServiceParameters struct {
 	Ports     []corev1.ServicePort
 }
 
-func CreateService(parameters ServiceParameters) {
-	svc := corev1.Service{
+func BuildService(parameters ServiceParameters) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
 		ObjectMeta: v1.ObjectMeta{
 			Name:      parameters.Name,
 			Namespace: parameters.Namespace,
@@ -28,10 +39,37 @@ func CreateService(parameters ServiceParameters) {
 			Ports:    parameters.Ports,
 		},
 	}
+}
+
+// ApplyService creates or updates the service with server-side apply, fields changed by others are taken back
+func ApplyService(parameters ServiceParameters) error {
+	svc := BuildService(parameters)
+	data, err := json.Marshal(svc)
+	if err != nil {
+		logrus.Errorf("json marshal svc err: %v", err)
+		return err
+	}
 
 	cs := clientset.GetClientset()
-	if _, err := cs.CoreV1().Services(svc.GetNamespace()).Create(context.TODO(), &svc, v1.CreateOptions{}); err != nil {
-		logrus.Errorf("create svc err: %v", err)
-		return
+	if _, err := cs.CoreV1().Services(svc.GetNamespace()).Patch(context.TODO(), svc.GetName(), types.ApplyPatchType, data, v1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &forceApply,
+	}); err != nil {
+		logrus.Errorf("apply svc err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func DeleteService(name, namespace string, dryRun bool) error {
+	options := v1.DeleteOptions{}
+	if dryRun {
+		options.DryRun = []string{v1.DryRunAll}
+	}
+	cs := clientset.GetClientset()
+	if err := cs.CoreV1().Services(namespace).Delete(context.TODO(), name, options); err != nil {
+		logrus.Debugf("delete svc err: %v", err)
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,113 @@
+package validatingwebhookconfiguration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+
+	"practices/admission-prac/pkg/clientset"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	FieldManager = "admission-prac"
+	forceApply   = true
+)
+
+type ValidatingWebhookConfigurationParameters struct {
+	ConfigurationName string
+	WebhookName       string
+	admissionregistrationv1.ServiceReference
+	// URL is used instead of the service reference when set, e.g. for a webhook running outside the cluster
+	URL                      string
+	FailurePolicy            admissionregistrationv1.FailurePolicyType
+	WebhookNamespaceSelector v1.LabelSelector
+	WebhookObjectSelector    v1.LabelSelector
+	TimeoutSeconds           int32
+	MatchPolicy              admissionregistrationv1.MatchPolicyType
+	CACert                   *bytes.Buffer
+}
+
+func BuildValidatingWebhookConfiguration(parameters ValidatingWebhookConfigurationParameters) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	clientConfig := admissionregistrationv1.WebhookClientConfig{
+		Service:  &parameters.ServiceReference,
+		CABundle: parameters.CACert.Bytes(),
+	}
+	if parameters.URL != "" {
+		clientConfig.Service = nil
+		clientConfig.URL = &parameters.URL
+	}
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "ValidatingWebhookConfiguration",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name: parameters.ConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name:         parameters.WebhookName,
+				ClientConfig: clientConfig,
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"apps"},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"deployments"},
+						},
+					},
+				},
+				TimeoutSeconds:          &parameters.TimeoutSeconds,
+				FailurePolicy:           &parameters.FailurePolicy,
+				NamespaceSelector:       &parameters.WebhookNamespaceSelector,
+				ObjectSelector:          &parameters.WebhookObjectSelector,
+				MatchPolicy:             &parameters.MatchPolicy,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				SideEffects: func() *admissionregistrationv1.SideEffectClass {
+					se := admissionregistrationv1.SideEffectClassNone
+					return &se
+				}(),
+			},
+		},
+	}
+}
+
+// ApplyValidatingWebhookConfiguration creates or updates the configuration with server-side apply
+func ApplyValidatingWebhookConfiguration(parameters ValidatingWebhookConfigurationParameters) error {
+	cfg := BuildValidatingWebhookConfiguration(parameters)
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("json marshal validatingwebhookconfiguration err: %v", err)
+		return err
+	}
+
+	validateAdmissionClient := clientset.GetClientset().AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	_, err = validateAdmissionClient.Patch(context.TODO(), cfg.GetName(), types.ApplyPatchType, data, v1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &forceApply,
+	})
+	if err != nil {
+		log.Printf("apply validatingwebhookconfiguration err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func DeleteValidatingWebhookConfiguration(name string, dryRun bool) error {
+	options := v1.DeleteOptions{}
+	if dryRun {
+		options.DryRun = []string{v1.DryRunAll}
+	}
+	validateAdmissionClient := clientset.GetClientset().AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	if err := validateAdmissionClient.Delete(context.TODO(), name, options); err != nil {
+		log.Printf("delete validatingwebhookconfiguration err: %v", err)
+		return err
+	}
+	return nil
+}